@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DeltaScratchpad/webhook-interface/config"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the resolved configuration",
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the configuration after applying the config file and environment, with secrets redacted",
+	Long: `Print the configuration the server would start with, in the format of the config file.
+
+Settings are taken from, in order of precedence, command line flags, environment
+variables, the config file and the defaults. Passwords, tokens and header values
+are redacted. The command fails if the configuration is invalid, after printing it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		resolved, validationErr := config.Load(viper.GetViper())
+		out, err := resolved.Redacted().YAML()
+		if err != nil {
+			return err
+		}
+		_, _ = os.Stdout.Write(out)
+		if validationErr != nil {
+			return fmt.Errorf("invalid config:\n%w", validationErr)
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
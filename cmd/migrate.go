@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/DeltaScratchpad/webhook-interface/schema"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Manage the database schema used by the SQL state backends",
+	Long: `Apply or roll back the versioned migrations embedded in the binary.
+
+The database is selected with --db-url or the DB_URL environment variable,
+postgres:// URLs use PostgreSQL and anything else is treated as a MySQL DSN.
+Databases created from the old hand-written schema are adopted on the first
+run of up instead of having their existing columns added again.`,
+}
+
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		migrator, db, err := openMigrator(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		applied, err := migrator.Up(cmd.Context())
+		for _, migration := range applied {
+			fmt.Printf("Applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("Schema is up to date")
+		}
+		return nil
+	},
+}
+
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Roll back the most recently applied migration",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		migrator, db, err := openMigrator(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		migration, err := migrator.Down(cmd.Context())
+		if err != nil {
+			return err
+		}
+		if migration == nil {
+			fmt.Println("No migrations to roll back")
+		} else {
+			fmt.Printf("Rolled back %04d_%s\n", migration.Version, migration.Name)
+		}
+		return nil
+	},
+}
+
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "List migrations and whether they have been applied",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		migrator, db, err := openMigrator(cmd)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		statuses, err := migrator.Status(cmd.Context())
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%04d_%s\tapplied %s\n", status.Version, status.Name, status.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%04d_%s\tpending\n", status.Version, status.Name)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.AddCommand(migrateUpCmd, migrateDownCmd, migrateStatusCmd)
+
+	migrateCmd.PersistentFlags().StringP("db-url", "d", "", "Database URL")
+}
+
+func openMigrator(cmd *cobra.Command) (*schema.Migrator, *sql.DB, error) {
+	db_url, _ := cmd.Flags().GetString("db-url")
+	if db_url == "" {
+		db_url = viper.GetString("state.db_url")
+	}
+	if db_url == "" {
+		return nil, nil, fmt.Errorf("no database URL provided, set --db-url or DB_URL")
+	}
+	return newMigrator(db_url)
+}
+
+func newMigrator(db_url string) (*schema.Migrator, *sql.DB, error) {
+	dialect, dsn := parseDBURL(db_url)
+	db, err := sql.Open(dialect, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	migrator, err := schema.NewMigrator(db, dialect)
+	if err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
+	return migrator, db, nil
+}
+
+// runAutoMigrate applies pending migrations before the server starts handling events.
+func runAutoMigrate(ctx context.Context, db_url string) error {
+	migrator, db, err := newMigrator(db_url)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := migrator.Up(ctx)
+	for _, migration := range applied {
+		slog.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+	}
+	return err
+}
@@ -4,9 +4,16 @@ Copyright © 2024 Andrew Averell aaverell@daedev.net
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strings"
 
+	"github.com/DeltaScratchpad/webhook-interface/config"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/schema"
 	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
 
 	"github.com/spf13/cobra"
@@ -14,7 +21,12 @@ import (
 )
 
 var cfgFile string
-var port *uint16
+
+// configFileUsed is the config file read by initConfig, logged by setup once the configured logger is installed.
+var configFileUsed string
+
+// cfg and state are set by setup once flags, the environment and the config file have been resolved.
+var cfg config.Config
 var state webhook_tracker.WebhookState
 
 // rootCmd represents the base command when called without any subcommands
@@ -48,32 +60,142 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
+	defaults := config.Default()
+	config.Bind(viper.GetViper())
+
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.webhook-interface.yaml)")
+	rootCmd.PersistentFlags().String("log-level", defaults.Logging.Level, "Log level, one of debug, info, warn or error")
+	_ = viper.BindPFlag("logging.level", rootCmd.PersistentFlags().Lookup("log-level"))
+	rootCmd.PersistentFlags().String("log-format", defaults.Logging.Format, "Log format, text or json")
+	_ = viper.BindPFlag("logging.format", rootCmd.PersistentFlags().Lookup("log-format"))
+	rootCmd.PersistentFlags().String("trace-exporter", defaults.Tracing.Exporter, "Trace exporter, one of none, stdout or otlp")
+	_ = viper.BindPFlag("tracing.exporter", rootCmd.PersistentFlags().Lookup("trace-exporter"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
-	port = serverCmd.PersistentFlags().Uint16P("port", "p", 80, "Port to listen on")
-	_ = viper.BindPFlag("PORT", serverCmd.PersistentFlags().Lookup("port"))
+	serverCmd.PersistentFlags().String("listen-address", defaults.Listen.Address, "Address to listen on, all interfaces if empty")
+	_ = viper.BindPFlag("listen.address", serverCmd.PersistentFlags().Lookup("listen-address"))
+	serverCmd.PersistentFlags().Uint16P("port", "p", defaults.Listen.Port, "Port to listen on")
+	_ = viper.BindPFlag("listen.port", serverCmd.PersistentFlags().Lookup("port"))
+
+	serverCmd.PersistentFlags().String("tls-cert-file", "", "Certificate to serve HTTPS with, requires --tls-key-file")
+	_ = viper.BindPFlag("tls.cert_file", serverCmd.PersistentFlags().Lookup("tls-cert-file"))
+	serverCmd.PersistentFlags().String("tls-key-file", "", "Private key for --tls-cert-file")
+	_ = viper.BindPFlag("tls.key_file", serverCmd.PersistentFlags().Lookup("tls-key-file"))
+	serverCmd.PersistentFlags().String("tls-client-ca-file", "", "CA certificates that clients of /query must present a certificate from (mTLS)")
+	_ = viper.BindPFlag("tls.client_ca_file", serverCmd.PersistentFlags().Lookup("tls-client-ca-file"))
+	serverCmd.PersistentFlags().String("tls-min-version", defaults.TLS.MinVersion, "Oldest TLS version accepted, one of 1.0, 1.1, 1.2 or 1.3")
+	_ = viper.BindPFlag("tls.min_version", serverCmd.PersistentFlags().Lookup("tls-min-version"))
+
+	serverCmd.PersistentFlags().StringP("db-url", "d", "", "Database URL")
+	_ = viper.BindPFlag("state.db_url", serverCmd.PersistentFlags().Lookup("db-url"))
+
+	serverCmd.PersistentFlags().Bool("auto-migrate", false, "Apply pending database migrations on startup")
+	_ = viper.BindPFlag("state.auto_migrate", serverCmd.PersistentFlags().Lookup("auto-migrate"))
+
+	serverCmd.PersistentFlags().StringSlice("ready-probe", nil, "Downstream URL checked by /readyz as name=url, reported under its name, may be repeated")
+	_ = viper.BindPFlag("ready_probes", serverCmd.PersistentFlags().Lookup("ready-probe"))
+
+	serverCmd.PersistentFlags().String("ingest-mode", defaults.Ingest.Mode, "How /query handles events: sync evaluates before responding, async responds 202 and queues them")
+	_ = viper.BindPFlag("ingest.mode", serverCmd.PersistentFlags().Lookup("ingest-mode"))
+	serverCmd.PersistentFlags().Int("ingest-workers", defaults.Ingest.Workers, "Number of workers processing queued events in async ingest mode")
+	_ = viper.BindPFlag("ingest.workers", serverCmd.PersistentFlags().Lookup("ingest-workers"))
+	serverCmd.PersistentFlags().Int("ingest-queue-size", defaults.Ingest.QueueSize, "Events that can wait for a worker before /query returns 429")
+	_ = viper.BindPFlag("ingest.queue_size", serverCmd.PersistentFlags().Lookup("ingest-queue-size"))
+
+	serverCmd.PersistentFlags().Int("max-batch-size", defaults.Ingest.MaxBatchSize, "Most events accepted in a single /query/batch request")
+	_ = viper.BindPFlag("ingest.max_batch_size", serverCmd.PersistentFlags().Lookup("max-batch-size"))
+	serverCmd.PersistentFlags().Int64("max-batch-bytes", defaults.Ingest.MaxBatchBytes, "Largest /query/batch body accepted, in bytes")
+	_ = viper.BindPFlag("ingest.max_batch_bytes", serverCmd.PersistentFlags().Lookup("max-batch-bytes"))
+
+	serverCmd.PersistentFlags().Duration("drain-timeout", defaults.Shutdown.DrainTimeout, "How long shutdown waits for accepted events to be forwarded")
+	_ = viper.BindPFlag("shutdown.drain_timeout", serverCmd.PersistentFlags().Lookup("drain-timeout"))
+	serverCmd.PersistentFlags().String("spool-file", "", "File to persist events still pending at the drain timeout, replayed on the next start")
+	_ = viper.BindPFlag("shutdown.spool_file", serverCmd.PersistentFlags().Lookup("spool-file"))
+
+	serverCmd.PersistentFlags().Duration("state-ttl", defaults.State.TTL, "How long to keep webhook call state after its last update, 0 keeps it forever")
+	_ = viper.BindPFlag("state.ttl", serverCmd.PersistentFlags().Lookup("state-ttl"))
+	serverCmd.PersistentFlags().Duration("state-purge-interval", defaults.State.PurgeInterval, "How often expired webhook call state is purged")
+	_ = viper.BindPFlag("state.purge_interval", serverCmd.PersistentFlags().Lookup("state-purge-interval"))
+
+	serverCmd.PersistentFlags().String("state-file", "", "Path to an embedded state file, used when no database URL is set")
+	_ = viper.BindPFlag("state.file", serverCmd.PersistentFlags().Lookup("state-file"))
+}
 
-	var _ = serverCmd.PersistentFlags().StringP("db-url", "d", "", "Database URL")
-	_ = viper.BindPFlag("DB_URL", serverCmd.PersistentFlags().Lookup("db-url"))
-	var db_url_env = os.Getenv("DB_URL")
-	db_url_lookup := serverCmd.PersistentFlags().Lookup("db-url")
-	var db_url string
-	if db_url_lookup == nil || db_url_lookup.Value.String() == "" {
-		db_url = db_url_env
-	} else {
-		db_url = db_url_lookup.Value.String()
+// setup loads and validates the config, then builds the state backend from it. It is the PersistentPreRunE
+// of every command that needs state, so nothing is opened for commands that don't, or before flags are parsed.
+func setup(cmd *cobra.Command, args []string) error {
+	// Flags have been parsed by now, so any error from here on isn't a usage error.
+	cmd.SilenceUsage = true
+	var err error
+	if cfg, err = config.Load(viper.GetViper()); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
 	}
+	// Install the configured logger before anything is logged, so every line has the configured level and format.
+	if logger, err := logging.New(os.Stderr, cfg.Logging.Level, cfg.Logging.Format); err == nil {
+		slog.SetDefault(logger)
+	}
+	if configFileUsed != "" {
+		slog.Info("Using config file", "path", configFileUsed)
+	}
+	state, err = newState(cfg.State.DBURL, cfg.State.File)
+	return err
+}
 
-	if db_url == "" {
-		_, _ = os.Stderr.WriteString("No DB URL provided, using in-memory storage")
-		state = webhook_tracker.NewLocalWebhookState()
-	} else {
-		_, _ = os.Stderr.WriteString("Using DB")
-		state = webhook_tracker.NewMySqlState(db_url)
+// teardown releases the state backend opened by setup, if it holds any resources.
+func teardown(cmd *cobra.Command, args []string) error {
+	if closer, ok := state.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func newState(db_url string, state_file string) (webhook_tracker.WebhookState, error) {
+	if db_url != "" {
+		return newStateFromURL(db_url)
+	} else if state_file != "" {
+		slog.Info("Using state file", "path", state_file)
+		boltState, err := webhook_tracker.NewBoltState(state_file)
+		if err != nil {
+			return nil, fmt.Errorf("opening state file %s: %w", state_file, err)
+		}
+		return boltState, nil
+	}
+	slog.Info("No DB URL provided, using in-memory storage")
+	return webhook_tracker.NewLocalWebhookState(), nil
+}
+
+// parseDBURL selects the SQL dialect from the scheme of the database URL, and returns the DSN to open it with.
+// postgres:// and postgresql:// URLs use PostgreSQL, anything else is treated as a MySQL DSN,
+// with an optional mysql:// prefix.
+func parseDBURL(db_url string) (dialect string, dsn string) {
+	switch {
+	case strings.HasPrefix(db_url, "postgres://"), strings.HasPrefix(db_url, "postgresql://"):
+		return schema.Postgres, db_url
+	default:
+		return schema.MySQL, strings.TrimPrefix(db_url, "mysql://")
+	}
+}
+
+func newStateFromURL(db_url string) (webhook_tracker.WebhookState, error) {
+	dialect, dsn := parseDBURL(db_url)
+	switch dialect {
+	case schema.Postgres:
+		slog.Info("Using PostgreSQL DB")
+		postgresState, err := webhook_tracker.NewPostgresState(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("opening PostgreSQL state: %w", err)
+		}
+		return postgresState, nil
+	default:
+		slog.Info("Using MySQL DB")
+		mysqlState, err := webhook_tracker.NewMySqlState(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("opening MySQL state: %w", err)
+		}
+		return mysqlState, nil
 	}
 }
 
@@ -93,10 +215,15 @@ func initConfig() {
 		viper.SetConfigName(".webhook-interface")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
+	// Environment variables are bound per key by config.Bind, including the names that predate the config file.
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	// If a config file is found, read it in. A missing default file is fine, but not a broken or missing --config.
+	configErr := viper.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if configErr != nil && (cfgFile != "" || !errors.As(configErr, &notFound)) {
+		cobra.CheckErr(fmt.Errorf("reading config file: %w", configErr))
+	}
+	if configErr == nil {
+		configFileUsed = viper.ConfigFileUsed()
 	}
 }
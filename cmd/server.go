@@ -4,15 +4,25 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 
+	"github.com/DeltaScratchpad/webhook-interface/config"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
 	"github.com/DeltaScratchpad/webhook-interface/server"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
 	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // serverCmd represents the server command
@@ -25,23 +35,159 @@ and usage of using your command. For example:
 Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Creating server")
+	PersistentPreRunE:  setup,
+	PersistentPostRunE: teardown,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Info("Creating server")
 		done := make(chan os.Signal, 1)
 		signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-		var setPort uint16
-		if port == nil {
-			setPort = 80
-		} else {
-			setPort = *port
+		shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, "webhook-interface")
+		if err != nil {
+			return fmt.Errorf("setting up tracing: %w", err)
 		}
+		defer func() {
+			_ = shutdownTracing(context.Background())
+		}()
 
+		instrumented := tracing.InstrumentState(metrics.InstrumentState(state))
 
-		server.CreateServer(nil, fmt.Sprintf("%d", setPort), done, state)
+		if cfg.State.AutoMigrate && cfg.State.DBURL != "" {
+			if err := runAutoMigrate(context.Background(), cfg.State.DBURL); err != nil {
+				return fmt.Errorf("migrating database: %w", err)
+			}
+		}
+
+		if cfg.State.TTL > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go webhook_tracker.RunJanitor(ctx, instrumented, cfg.State.TTL, cfg.State.PurgeInterval)
+		}
+
+		if len(authenticators(cfg)) == 0 {
+			slog.Warn("No credentials configured, anyone who can reach the server can make it call webhooks")
+		}
+		destinations := cfg.DestinationRegistry()
+		options, err := serverOptions(cfg, instrumented, destinations)
+		if err != nil {
+			return err
+		}
+		srv := server.New(options...)
+		if err := srv.Start(context.Background()); err != nil {
+			return err
+		}
+
+		// Reload settings that can change at runtime when the config file changes, or on SIGHUP.
+		// Reloads are applied one at a time, so running and destinations are only used from one goroutine at once.
+		running := cfg
+		reloader := config.NewReloader(viper.GetViper(), cfg, func(updated config.Config) {
+			destinations = updated.UpdateDestinations(running, destinations)
+			running = updated
+			srv.Reload(reloadableOptions(updated, destinations)...)
+		})
+		watchCtx, stopWatching := context.WithCancel(context.Background())
+		defer stopWatching()
+		if err := reloader.Watch(watchCtx); err != nil {
+			slog.Error("Config file changes won't be reloaded, send SIGHUP instead", "error", err)
+		}
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+
+		// Wait for interrupt signal to gracefully shutdown the server
+	wait:
+		for {
+			select {
+			case <-hangup:
+				slog.Info("Received SIGHUP, reloading config")
+				_ = reloader.Reload()
+			case <-done:
+				break wait
+			}
+		}
+		if err := srv.Shutdown(context.Background()); err != nil {
+			slog.Error("Server did not stop cleanly", "error", err)
+		}
+		return nil
 	},
 }
 
+// serverOptions translates the config into options for server.New.
+func serverOptions(cfg config.Config, state webhook_tracker.WebhookState, destinations *destination.Registry) ([]server.Option, error) {
+	options := append(reloadableOptions(cfg, destinations),
+		server.WithAddr(net.JoinHostPort(cfg.Listen.Address, strconv.Itoa(int(cfg.Listen.Port)))),
+		server.WithState(state),
+		server.WithIngest(server.IngestConfig{
+			Mode:           cfg.Ingest.Mode,
+			Workers:        cfg.Ingest.Workers,
+			QueueSize:      cfg.Ingest.QueueSize,
+			MaxBatchSize:   cfg.Ingest.MaxBatchSize,
+			MaxBatchBytes:  cfg.Ingest.MaxBatchBytes,
+			BatchEndpoints: cfg.Ingest.BatchEndpointMap(),
+		}),
+		server.WithShutdown(server.ShutdownConfig{
+			DrainTimeout: cfg.Shutdown.DrainTimeout,
+			SpoolFile:    cfg.Shutdown.SpoolFile,
+		}),
+		server.WithHTTPTimeouts(server.HTTPTimeouts{
+			ReadHeader: cfg.Timeouts.ReadHeader,
+			Read:       cfg.Timeouts.Read,
+			Write:      cfg.Timeouts.Write,
+			Idle:       cfg.Timeouts.Idle,
+		}),
+	)
+
+	if cfg.TLS.CertFile != "" {
+		minVersion, err := server.ParseTLSVersion(cfg.TLS.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, server.WithTLSFiles(server.TLSFiles{
+			CertFile:     cfg.TLS.CertFile,
+			KeyFile:      cfg.TLS.KeyFile,
+			ClientCAFile: cfg.TLS.ClientCAFile,
+			MinVersion:   minVersion,
+		}))
+	}
+	return options, nil
+}
+
+// reloadableOptions translates the settings that server.Reload can change at runtime.
+// The logger is rebuilt too, so a new level or format applies everywhere, not only to requests.
+// Destinations are built by the caller, so a reload can carry over the ones that haven't changed.
+func reloadableOptions(cfg config.Config, destinations *destination.Registry) []server.Option {
+	options := []server.Option{
+		server.WithReadyProbes(cfg.ReadyProbeMap()),
+		server.WithRetryPolicy(cfg.RetryPolicy()),
+		server.WithWebhookClient(cfg.WebhookClient()),
+		server.WithForwardClient(cfg.ForwardClient()),
+		server.WithDestinations(destinations),
+	}
+	if authenticators := authenticators(cfg); len(authenticators) > 0 {
+		options = append(options, server.WithAuthenticators(authenticators...))
+	}
+	if logger, err := logging.New(os.Stderr, cfg.Logging.Level, cfg.Logging.Format); err == nil {
+		slog.SetDefault(logger)
+		options = append(options, server.WithLogger(logger))
+	}
+	return options
+}
+
+// authenticators builds inbound authentication from the credentials.
+// When client certificates are required, a verified certificate is enough on its own.
+func authenticators(cfg config.Config) []server.Authenticator {
+	var authenticators []server.Authenticator
+	if cfg.TLS.ClientCAFile != "" {
+		authenticators = append(authenticators, server.ClientCertificates(cfg.Credentials.ClientNames...))
+	}
+	if len(cfg.Credentials.BearerTokens) > 0 {
+		authenticators = append(authenticators, server.BearerTokens(cfg.Credentials.BearerTokens...))
+	}
+	if len(cfg.Credentials.HMACSecrets) > 0 {
+		authenticators = append(authenticators, server.HMACSignatures(cfg.Credentials.HMACSecrets...))
+	}
+	return authenticators
+}
+
 func init() {
 	rootCmd.AddCommand(serverCmd)
 
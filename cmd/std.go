@@ -4,12 +4,19 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
 
 	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
 	"github.com/DeltaScratchpad/webhook-interface/processing"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
+	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
 
 	"github.com/spf13/cobra"
 )
@@ -24,9 +31,32 @@ and usage of using your command. For example:
 Cobra is a CLI library for Go that empowers applications.
 This application is a tool to generate the needed files
 to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		_, _ = os.Stderr.WriteString("Webhook starting!.\n")
-		runStd()
+	PersistentPreRunE:  setup,
+	PersistentPostRunE: teardown,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Info("Webhook starting")
+		shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, "webhook-interface")
+		if err != nil {
+			return fmt.Errorf("setting up tracing: %w", err)
+		}
+		defer func() {
+			_ = shutdownTracing(context.Background())
+		}()
+		ctx := helpers.WithRetryPolicy(context.Background(), cfg.RetryPolicy())
+		ctx = helpers.WithWebhookClient(ctx, cfg.WebhookClient())
+		ctx = helpers.WithForwardClient(ctx, cfg.ForwardClient())
+		destinations := cfg.DestinationRegistry()
+		ctx = destination.WithRegistry(ctx, destinations)
+		runStd(ctx, tracing.InstrumentState(state))
+
+		// Send the digests still held back once stdin is done, as the server does on shutdown.
+		closeCtx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.DrainTimeout)
+		defer cancel()
+		if err := destinations.Close(closeCtx); err != nil {
+			slog.Error("Error closing destinations", "error", err)
+			return fmt.Errorf("closing destinations: %w", err)
+		}
+		return nil
 	},
 }
 
@@ -45,31 +75,40 @@ func init() {
 
 }
 
-func runStd() {
+func runStd(baseCtx context.Context, state webhook_tracker.WebhookState) {
 	if isInputFromPipe() {
-		var query go_system_api.ProcessingEvent
 		decoder := json.NewDecoder(os.Stdin)
 		encoder := json.NewEncoder(os.Stdout)
 		for {
+			var query go_system_api.ProcessingEvent
 			err := decoder.Decode(&query)
 			if err != nil {
 				if err.Error() == "EOF" {
 					break
 				} else {
-					_, _ = os.Stderr.WriteString(fmt.Sprintf("Error when reading stdin: %s\n", err))
+					// The decoder can't resynchronise after malformed JSON, so stop rather than reprocess the last event.
+					slog.Error("Error when reading stdin", "error", err)
+					break
 				}
 			}
-			processing.ProcessProcessingEvent(&query, state)
+			logger := slog.Default().With("request_id", logging.NewRequestID(), "query_id", query.Commands.QueryId, "step", query.Commands.Step)
+			ctx := logging.WithContext(baseCtx, logger)
+			if err := helpers.ValidateProcessingEvent(&query); err != nil {
+				logger.Warn("Skipping invalid event", "error", err)
+				helpers.LogError(ctx, fmt.Sprintf("Invalid event: %s", err), &query)
+				continue
+			}
+			processing.ProcessProcessingEvent(ctx, &query, state)
 			query.Commands.Step += 1
 			err = encoder.Encode(&query)
 			if err != nil {
-				_, _ = os.Stderr.WriteString(fmt.Sprintf("Error when reading stdout: %s\n", err))
+				logger.Error("Error when writing stdout", "error", err)
 				break
 			}
 		}
 
 	} else {
-		_, _ = os.Stderr.WriteString("No input from pipe.\n")
+		slog.Error("No input from pipe")
 	}
 }
 
@@ -81,7 +120,7 @@ func isInputFromPipe() bool {
 func PushToStdOut(event *go_system_api.ProcessingEvent) {
 	err := json.NewEncoder(os.Stdout).Encode(event)
 	if err != nil {
-		_, _ = os.Stderr.WriteString(fmt.Sprintf("Error: %s\n", err))
+		slog.Error("Error writing event to stdout", "error", err)
 		return
 	}
 }
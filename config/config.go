@@ -0,0 +1,769 @@
+// Package config defines the settings of the webhook interface, and loads them from flags,
+// environment variables and the config file, in that order of precedence.
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/egress"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/server"
+	"github.com/spf13/viper"
+)
+
+type Config struct {
+	Listen       ListenConfig                 `mapstructure:"listen"`
+	TLS          TLSConfig                    `mapstructure:"tls"`
+	State        StateConfig                  `mapstructure:"state"`
+	Ingest       IngestConfig                 `mapstructure:"ingest"`
+	Shutdown     ShutdownConfig               `mapstructure:"shutdown"`
+	Retries      RetryConfig                  `mapstructure:"retries"`
+	Timeouts     TimeoutConfig                `mapstructure:"timeouts"`
+	ReadyProbes  []string                     `mapstructure:"ready_probes"` // Each given as name=url, /readyz only shows the name
+	Destinations map[string]DestinationConfig `mapstructure:"destinations"`
+	Credentials  CredentialsConfig            `mapstructure:"credentials"`
+	Egress       EgressConfig                 `mapstructure:"egress"`
+	Logging      LoggingConfig                `mapstructure:"logging"`
+	Tracing      TracingConfig                `mapstructure:"tracing"`
+}
+
+type ListenConfig struct {
+	// Address is the interface to listen on, empty for all of them.
+	Address string `mapstructure:"address"`
+	Port    uint16 `mapstructure:"port"`
+}
+
+// TLSConfig enables HTTPS when a certificate and key are set. The files are reloaded when they change.
+type TLSConfig struct {
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// ClientCAFile requires clients of /query to present a certificate signed by one of these CAs. Health checks
+	// and metrics stay open to clients without one.
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	MinVersion   string `mapstructure:"min_version"`
+}
+
+type StateConfig struct {
+	// DBURL selects an SQL backend, postgres:// for PostgreSQL and anything else for MySQL.
+	DBURL string `mapstructure:"db_url"`
+	// File selects the embedded backend when there is no DBURL. Without either, state is kept in memory.
+	File          string        `mapstructure:"file"`
+	TTL           time.Duration `mapstructure:"ttl"`
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+	AutoMigrate   bool          `mapstructure:"auto_migrate"`
+}
+
+type IngestConfig struct {
+	Mode         string `mapstructure:"mode"`
+	Workers      int    `mapstructure:"workers"`
+	QueueSize    int    `mapstructure:"queue_size"`
+	MaxBatchSize int    `mapstructure:"max_batch_size"`
+	// MaxBatchBytes caps the size of a /query/batch body, larger ones get a 413.
+	MaxBatchBytes int64 `mapstructure:"max_batch_bytes"`
+	// BatchEndpoints lists the next steps that take batches, other next steps get events one at a time.
+	BatchEndpoints []BatchEndpointConfig `mapstructure:"batch_endpoints"`
+}
+
+// BatchEndpointConfig is the batch endpoint of a next step, e.g. http://next/query/batch for http://next/query.
+type BatchEndpointConfig struct {
+	Next  string `mapstructure:"next"`
+	Batch string `mapstructure:"batch"`
+}
+
+// BatchEndpointMap maps each next step to its batch endpoint, as server.IngestConfig takes them.
+func (c IngestConfig) BatchEndpointMap() map[string]string {
+	if len(c.BatchEndpoints) == 0 {
+		return nil
+	}
+	endpoints := make(map[string]string, len(c.BatchEndpoints))
+	for _, endpoint := range c.BatchEndpoints {
+		endpoints[endpoint.Next] = endpoint.Batch
+	}
+	return endpoints
+}
+
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+	SpoolFile    string        `mapstructure:"spool_file"`
+}
+
+type RetryConfig struct {
+	WebhookAttempts int           `mapstructure:"webhook_attempts"`
+	ForwardAttempts int           `mapstructure:"forward_attempts"`
+	Backoff         time.Duration `mapstructure:"backoff"`
+}
+
+// TimeoutConfig bounds outbound requests, and the reads and writes of the HTTP server. Zero means no timeout.
+type TimeoutConfig struct {
+	Webhook    time.Duration `mapstructure:"webhook"`
+	Forward    time.Duration `mapstructure:"forward"`
+	ReadHeader time.Duration `mapstructure:"read_header"`
+	Read       time.Duration `mapstructure:"read"`
+	Write      time.Duration `mapstructure:"write"`
+	Idle       time.Duration `mapstructure:"idle"`
+}
+
+// Destination types. Chat types post a message formatted for the tool to its incoming webhook URL.
+// Email destinations are set up in the email section, and have no URL. Message broker destinations are set up
+// in the broker section, and only use the url for NATS and AMQP.
+const (
+	DestinationHTTP    = "http"
+	DestinationSlack   = "slack"
+	DestinationTeams   = "teams"
+	DestinationDiscord = "discord"
+	DestinationEmail   = "email"
+	DestinationKafka   = "kafka"
+	DestinationNATS    = "nats"
+	DestinationAMQP    = "amqp"
+)
+
+// DestinationConfig is a webhook target that args can refer to as @name.
+type DestinationConfig struct {
+	// Type defaults to http. Method, headers and auth only apply to http destinations.
+	Type string `mapstructure:"type"`
+	URL  string `mapstructure:"url"`
+	// Method defaults to GET. Other methods send the event as a JSON body.
+	Method    string            `mapstructure:"method"`
+	Headers   map[string]string `mapstructure:"headers"`
+	Auth      DestinationAuth   `mapstructure:"auth"`
+	RateLimit RateLimitConfig   `mapstructure:"rate_limit"`
+	Email     EmailConfig       `mapstructure:"email"`
+	Broker    BrokerConfig      `mapstructure:"broker"`
+}
+
+// BrokerConfig publishes to Kafka, NATS or an AMQP broker such as RabbitMQ.
+type BrokerConfig struct {
+	// Brokers are the host:port addresses of the Kafka brokers. NATS and AMQP use the destination's url,
+	// which holds any credentials.
+	Brokers []string `mapstructure:"brokers"`
+	// Topic is the Kafka topic, NATS subject or AMQP routing key.
+	Topic string `mapstructure:"topic"`
+	// Exchange is the AMQP exchange, empty for the default exchange, which routes to the queue named by topic.
+	Exchange string `mapstructure:"exchange"`
+	// TLS, Username and Password connect to Kafka with TLS and SASL/PLAIN.
+	TLS      bool   `mapstructure:"tls"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Payload is a Go template, see destination.PayloadData for what it can use. Empty publishes the same JSON
+	// an http destination would POST.
+	Payload string `mapstructure:"payload"`
+}
+
+// EmailConfig sends notifications through an SMTP server.
+type EmailConfig struct {
+	Host     string   `mapstructure:"host"`
+	Port     int      `mapstructure:"port"`
+	From     string   `mapstructure:"from"`
+	To       []string `mapstructure:"to"`
+	Username string   `mapstructure:"username"`
+	Password string   `mapstructure:"password"`
+	// Security is starttls, the default, tls for implicit TLS, or none.
+	Security string `mapstructure:"security"`
+	// Subject and Body are Go templates, see destination.EmailData for what they can use.
+	Subject string `mapstructure:"subject"`
+	Body    string `mapstructure:"body"`
+	// DigestWindow collects the matches within it into one email. Zero sends each match straight away.
+	DigestWindow time.Duration `mapstructure:"digest_window"`
+	DigestMax    int           `mapstructure:"digest_max"`
+}
+
+// DestinationAuth sets the Authorization header, from a bearer token or a username and password.
+type DestinationAuth struct {
+	BearerToken string `mapstructure:"bearer_token"`
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+}
+
+// RateLimitConfig spreads out sends to a destination. Zero per_second means no limit.
+type RateLimitConfig struct {
+	PerSecond float64 `mapstructure:"per_second"`
+	Burst     int     `mapstructure:"burst"`
+}
+
+// CredentialsConfig holds the secrets callers can use to authenticate to the server.
+// When none are set, and there is no tls.client_ca_file, /query is open to anyone who can reach it.
+type CredentialsConfig struct {
+	BearerTokens []string `mapstructure:"bearer_tokens"`
+	HMACSecrets  []string `mapstructure:"hmac_secrets"`
+	// ClientNames limits callers authenticated by client certificate to these common names.
+	ClientNames []string `mapstructure:"client_names"`
+}
+
+// EgressConfig limits where outbound requests may go. Webhook URLs come from event payloads, so by default
+// they may only reach public addresses. The pipeline, the next steps and error URLs, usually runs on an
+// internal network, so it may reach private addresses, but not link-local ones such as cloud metadata.
+type EgressConfig struct {
+	Webhooks EgressRules `mapstructure:"webhooks"`
+	Pipeline EgressRules `mapstructure:"pipeline"`
+}
+
+// EgressRules are converted to an egress.Policy, see there for how they apply.
+type EgressRules struct {
+	Schemes        []string `mapstructure:"schemes"`
+	AllowHosts     []string `mapstructure:"allow_hosts"`
+	DenyHosts      []string `mapstructure:"deny_hosts"`
+	AllowCIDRs     []string `mapstructure:"allow_cidrs"`
+	DenyCIDRs      []string `mapstructure:"deny_cidrs"`
+	AllowPrivate   bool     `mapstructure:"allow_private"`
+	AllowLinkLocal bool     `mapstructure:"allow_link_local"`
+}
+
+type LoggingConfig struct {
+	Level  string `mapstructure:"level"`
+	Format string `mapstructure:"format"`
+}
+
+type TracingConfig struct {
+	Exporter string `mapstructure:"exporter"`
+}
+
+// Default returns the settings used for anything not set by a flag, the environment or the config file.
+func Default() Config {
+	return Config{
+		Listen: ListenConfig{Port: 80},
+		TLS:    TLSConfig{MinVersion: "1.2"},
+		State: StateConfig{
+			PurgeInterval: time.Minute,
+		},
+		Ingest: IngestConfig{
+			Mode:          server.IngestSync,
+			Workers:       8,
+			QueueSize:     1000,
+			MaxBatchSize:  server.DefaultMaxBatchSize,
+			MaxBatchBytes: server.DefaultMaxBatchBytes,
+		},
+		Shutdown: ShutdownConfig{DrainTimeout: server.DefaultDrainTimeout},
+		Retries: RetryConfig{
+			WebhookAttempts: helpers.DefaultRetryPolicy.WebhookAttempts,
+			ForwardAttempts: helpers.DefaultRetryPolicy.ForwardAttempts,
+		},
+		Timeouts: TimeoutConfig{
+			Webhook:    10 * time.Second,
+			Forward:    30 * time.Second,
+			ReadHeader: 10 * time.Second,
+			Idle:       2 * time.Minute,
+		},
+		Egress: EgressConfig{
+			Webhooks: EgressRules{Schemes: []string{"http", "https"}},
+			Pipeline: EgressRules{Schemes: []string{"http", "https"}, AllowPrivate: true},
+		},
+		Logging: LoggingConfig{Level: "info", Format: "text"},
+		Tracing: TracingConfig{Exporter: "none"},
+	}
+}
+
+// envNames lists the environment variables read for each key, in order of preference.
+// The unprefixed names predate the config file and are kept so existing deployments keep working.
+var envNames = map[string][]string{
+	"listen.address":                   {"LISTEN_ADDRESS"},
+	"listen.port":                      {"LISTEN_PORT", "PORT"},
+	"tls.cert_file":                    {"TLS_CERT_FILE"},
+	"tls.key_file":                     {"TLS_KEY_FILE"},
+	"tls.client_ca_file":               {"TLS_CLIENT_CA_FILE"},
+	"tls.min_version":                  {"TLS_MIN_VERSION"},
+	"state.db_url":                     {"STATE_DB_URL", "DB_URL"},
+	"state.file":                       {"STATE_FILE"},
+	"state.ttl":                        {"STATE_TTL"},
+	"state.purge_interval":             {"STATE_PURGE_INTERVAL"},
+	"state.auto_migrate":               {"STATE_AUTO_MIGRATE", "AUTO_MIGRATE"},
+	"ingest.mode":                      {"INGEST_MODE"},
+	"ingest.workers":                   {"INGEST_WORKERS"},
+	"ingest.queue_size":                {"INGEST_QUEUE_SIZE"},
+	"ingest.max_batch_size":            {"INGEST_MAX_BATCH_SIZE", "MAX_BATCH_SIZE"},
+	"ingest.max_batch_bytes":           {"INGEST_MAX_BATCH_BYTES"},
+	"shutdown.drain_timeout":           {"SHUTDOWN_DRAIN_TIMEOUT", "DRAIN_TIMEOUT"},
+	"shutdown.spool_file":              {"SHUTDOWN_SPOOL_FILE", "SPOOL_FILE"},
+	"retries.webhook_attempts":         {"RETRIES_WEBHOOK_ATTEMPTS"},
+	"retries.forward_attempts":         {"RETRIES_FORWARD_ATTEMPTS"},
+	"retries.backoff":                  {"RETRIES_BACKOFF"},
+	"timeouts.webhook":                 {"TIMEOUTS_WEBHOOK"},
+	"timeouts.forward":                 {"TIMEOUTS_FORWARD"},
+	"timeouts.read_header":             {"TIMEOUTS_READ_HEADER"},
+	"timeouts.read":                    {"TIMEOUTS_READ"},
+	"timeouts.write":                   {"TIMEOUTS_WRITE"},
+	"timeouts.idle":                    {"TIMEOUTS_IDLE"},
+	"ready_probes":                     {"READY_PROBES"},
+	"credentials.bearer_tokens":        {"CREDENTIALS_BEARER_TOKENS"},
+	"credentials.hmac_secrets":         {"CREDENTIALS_HMAC_SECRETS"},
+	"credentials.client_names":         {"CREDENTIALS_CLIENT_NAMES"},
+	"egress.webhooks.schemes":          {"EGRESS_WEBHOOKS_SCHEMES"},
+	"egress.webhooks.allow_hosts":      {"EGRESS_WEBHOOKS_ALLOW_HOSTS"},
+	"egress.webhooks.deny_hosts":       {"EGRESS_WEBHOOKS_DENY_HOSTS"},
+	"egress.webhooks.allow_cidrs":      {"EGRESS_WEBHOOKS_ALLOW_CIDRS"},
+	"egress.webhooks.deny_cidrs":       {"EGRESS_WEBHOOKS_DENY_CIDRS"},
+	"egress.webhooks.allow_private":    {"EGRESS_WEBHOOKS_ALLOW_PRIVATE"},
+	"egress.webhooks.allow_link_local": {"EGRESS_WEBHOOKS_ALLOW_LINK_LOCAL"},
+	"egress.pipeline.schemes":          {"EGRESS_PIPELINE_SCHEMES"},
+	"egress.pipeline.allow_hosts":      {"EGRESS_PIPELINE_ALLOW_HOSTS"},
+	"egress.pipeline.deny_hosts":       {"EGRESS_PIPELINE_DENY_HOSTS"},
+	"egress.pipeline.allow_cidrs":      {"EGRESS_PIPELINE_ALLOW_CIDRS"},
+	"egress.pipeline.deny_cidrs":       {"EGRESS_PIPELINE_DENY_CIDRS"},
+	"egress.pipeline.allow_private":    {"EGRESS_PIPELINE_ALLOW_PRIVATE"},
+	"egress.pipeline.allow_link_local": {"EGRESS_PIPELINE_ALLOW_LINK_LOCAL"},
+	"logging.level":                    {"LOGGING_LEVEL", "LOG_LEVEL"},
+	"logging.format":                   {"LOGGING_FORMAT", "LOG_FORMAT"},
+	"tracing.exporter":                 {"TRACING_EXPORTER", "TRACE_EXPORTER"},
+}
+
+// Bind registers the defaults and environment variables of every key on v. Flags are bound by the caller.
+func Bind(v *viper.Viper) {
+	for key, value := range flatten(Default()) {
+		v.SetDefault(key, value)
+	}
+	for key, names := range envNames {
+		_ = v.BindEnv(append([]string{key}, names...)...)
+	}
+}
+
+// Load resolves the config from v and validates it.
+func Load(v *viper.Viper) (Config, error) {
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return config, fmt.Errorf("reading config: %w", err)
+	}
+	return config, config.Validate()
+}
+
+// Validate reports every invalid setting at once, so they can all be fixed in one go.
+func (c Config) Validate() error {
+	var errs []error
+	invalid := func(key string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		invalid("tls", "cert_file and key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		invalid("tls.client_ca_file", "needs cert_file and key_file, client certificates are only checked over HTTPS")
+	}
+	if _, err := server.ParseTLSVersion(c.TLS.MinVersion); err != nil {
+		invalid("tls.min_version", "%s", err)
+	}
+
+	if c.State.TTL < 0 {
+		invalid("state.ttl", "must not be negative")
+	}
+	if c.State.TTL > 0 && c.State.PurgeInterval <= 0 {
+		invalid("state.purge_interval", "must be positive when state.ttl is set")
+	}
+
+	if c.Ingest.Mode != server.IngestSync && c.Ingest.Mode != server.IngestAsync {
+		invalid("ingest.mode", "must be %s or %s, got %q", server.IngestSync, server.IngestAsync, c.Ingest.Mode)
+	}
+	if c.Ingest.Workers < 1 {
+		invalid("ingest.workers", "must be at least 1")
+	}
+	if c.Ingest.QueueSize < 0 {
+		invalid("ingest.queue_size", "must not be negative")
+	}
+	if c.Ingest.MaxBatchSize < 1 {
+		invalid("ingest.max_batch_size", "must be at least 1")
+	}
+	if c.Ingest.MaxBatchBytes < 1 {
+		invalid("ingest.max_batch_bytes", "must be at least 1")
+	}
+	for _, endpoint := range c.Ingest.BatchEndpoints {
+		for _, raw := range []string{endpoint.Next, endpoint.Batch} {
+			if err := validateHTTPURL(raw); err != nil {
+				invalid("ingest.batch_endpoints", "%s", err)
+			}
+		}
+	}
+
+	if c.Shutdown.DrainTimeout <= 0 {
+		invalid("shutdown.drain_timeout", "must be positive")
+	}
+
+	if c.Retries.WebhookAttempts < 1 {
+		invalid("retries.webhook_attempts", "must be at least 1")
+	}
+	if c.Retries.ForwardAttempts < 1 {
+		invalid("retries.forward_attempts", "must be at least 1")
+	}
+	if c.Retries.Backoff < 0 {
+		invalid("retries.backoff", "must not be negative")
+	}
+
+	timeouts := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"timeouts.webhook", c.Timeouts.Webhook},
+		{"timeouts.forward", c.Timeouts.Forward},
+		{"timeouts.read_header", c.Timeouts.ReadHeader},
+		{"timeouts.read", c.Timeouts.Read},
+		{"timeouts.write", c.Timeouts.Write},
+		{"timeouts.idle", c.Timeouts.Idle},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value < 0 {
+			invalid(timeout.key, "must not be negative")
+		}
+	}
+
+	probeNames := make(map[string]bool, len(c.ReadyProbes))
+	for _, probe := range c.ReadyProbes {
+		name, target, ok := strings.Cut(probe, "=")
+		switch {
+		case !ok || name == "":
+			invalid("ready_probes", "%q must be given as name=url", probe)
+			continue
+		case name == "state":
+			invalid("ready_probes", "the name state is taken by the state backend")
+		case probeNames[name]:
+			invalid("ready_probes", "%s is used more than once", name)
+		}
+		probeNames[name] = true
+		if err := validateHTTPURL(target); err != nil {
+			invalid("ready_probes", "%s: %s", name, err)
+		}
+	}
+	names := make([]string, 0, len(c.Destinations))
+	for name := range c.Destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		destination := c.Destinations[name]
+		if strings.TrimSpace(name) == "" {
+			invalid("destinations", "names must not be empty")
+		}
+		if strings.ContainsAny(name, " @") {
+			invalid("destinations."+name, "names must not contain spaces or @")
+		}
+		switch destination.Type {
+		case "", DestinationHTTP, DestinationSlack, DestinationTeams, DestinationDiscord, DestinationEmail,
+			DestinationKafka, DestinationNATS, DestinationAMQP:
+		default:
+			invalid("destinations."+name+".type", "must be one of http, slack, teams, discord, email, kafka, nats or amqp, got %q", destination.Type)
+		}
+		switch destination.Type {
+		case DestinationEmail:
+			validateEmail("destinations."+name+".email", destination.Email, invalid)
+		case DestinationKafka, DestinationNATS, DestinationAMQP:
+			validateBroker("destinations."+name, destination, invalid)
+		default:
+			if err := validateHTTPURL(destination.URL); err != nil {
+				invalid("destinations."+name+".url", "%s", err)
+			}
+		}
+		switch strings.ToUpper(destination.Method) {
+		case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			invalid("destinations."+name+".method", "must be GET, POST, PUT or PATCH, got %q", destination.Method)
+		}
+		if destination.Auth.BearerToken != "" && (destination.Auth.Username != "" || destination.Auth.Password != "") {
+			invalid("destinations."+name+".auth", "set either bearer_token or username and password, not both")
+		}
+		if destination.RateLimit.PerSecond < 0 || destination.RateLimit.Burst < 0 {
+			invalid("destinations."+name+".rate_limit", "must not be negative")
+		}
+	}
+	for _, token := range c.Credentials.BearerTokens {
+		if token == "" {
+			invalid("credentials.bearer_tokens", "tokens must not be empty")
+		}
+	}
+	for _, secret := range c.Credentials.HMACSecrets {
+		if secret == "" {
+			invalid("credentials.hmac_secrets", "secrets must not be empty")
+		}
+	}
+	if len(c.Credentials.ClientNames) > 0 && c.TLS.ClientCAFile == "" {
+		invalid("credentials.client_names", "needs tls.client_ca_file to verify client certificates")
+	}
+
+	for _, rules := range []struct {
+		key   string
+		rules EgressRules
+	}{
+		{"egress.webhooks", c.Egress.Webhooks},
+		{"egress.pipeline", c.Egress.Pipeline},
+	} {
+		for _, scheme := range rules.rules.Schemes {
+			if scheme != "http" && scheme != "https" {
+				invalid(rules.key+".schemes", "only http and https are supported, got %q", scheme)
+			}
+		}
+		if _, err := rules.rules.Policy(); err != nil {
+			invalid(rules.key, "%s", err)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Logging.Level)); err != nil {
+		invalid("logging.level", "must be debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	if format := strings.ToLower(c.Logging.Format); format != "text" && format != "json" {
+		invalid("logging.format", "must be text or json, got %q", c.Logging.Format)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "", "stdout", "otlp":
+	default:
+		invalid("tracing.exporter", "must be none, stdout or otlp, got %q", c.Tracing.Exporter)
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateEmail(key string, email EmailConfig, invalid func(key string, format string, args ...interface{})) {
+	if email.Host == "" || email.Port < 1 || email.Port > 65535 {
+		invalid(key, "host and port are required")
+	}
+	if _, err := mail.ParseAddress(email.From); err != nil {
+		invalid(key+".from", "%s", err)
+	}
+	if len(email.To) == 0 {
+		invalid(key+".to", "at least one recipient is required")
+	}
+	for _, to := range email.To {
+		if _, err := mail.ParseAddress(to); err != nil {
+			invalid(key+".to", "%s", err)
+		}
+	}
+	switch email.Security {
+	case "", destination.SMTPStartTLS, destination.SMTPTLS, destination.SMTPPlain:
+	default:
+		invalid(key+".security", "must be starttls, tls or none, got %q", email.Security)
+	}
+	if email.Security == destination.SMTPPlain && email.Username != "" {
+		invalid(key+".security", "credentials are never sent unencrypted, use starttls or tls")
+	}
+	if _, _, err := destination.ParseEmailTemplates(email.Subject, email.Body); err != nil {
+		invalid(key, "%s", err)
+	}
+	if email.DigestWindow < 0 || email.DigestMax < 0 {
+		invalid(key, "digest_window and digest_max must not be negative")
+	}
+}
+
+func validateBroker(key string, config DestinationConfig, invalid func(key string, format string, args ...interface{})) {
+	broker := config.Broker
+	switch config.Type {
+	case DestinationKafka:
+		if len(broker.Brokers) == 0 {
+			invalid(key+".broker.brokers", "at least one broker is required")
+		}
+		for _, address := range broker.Brokers {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				invalid(key+".broker.brokers", "%s", err)
+			}
+		}
+		if broker.Topic == "" {
+			invalid(key+".broker.topic", "is required")
+		}
+		if broker.Username != "" && !broker.TLS {
+			invalid(key+".broker.tls", "credentials are never sent unencrypted, set tls")
+		}
+	case DestinationNATS:
+		validateBrokerURL(key+".url", config.URL, []string{"nats", "tls"}, invalid)
+		if broker.Topic == "" || strings.ContainsAny(broker.Topic, " *>") {
+			invalid(key+".broker.topic", "must be a subject without spaces or wildcards, got %q", broker.Topic)
+		}
+	case DestinationAMQP:
+		validateBrokerURL(key+".url", config.URL, []string{"amqp", "amqps"}, invalid)
+		if broker.Exchange == "" && broker.Topic == "" {
+			invalid(key+".broker", "set the exchange, or the topic to publish to a queue through the default exchange")
+		}
+	}
+	if _, err := destination.ParsePayloadTemplate(broker.Payload); err != nil {
+		invalid(key+".broker.payload", "%s", err)
+	}
+}
+
+func validateBrokerURL(key string, raw string, schemes []string, invalid func(key string, format string, args ...interface{})) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		// The error repeats the URL, which may hold a password.
+		invalid(key, "is not a valid URL")
+		return
+	}
+	if !slices.Contains(schemes, parsed.Scheme) || parsed.Host == "" {
+		invalid(key, "must be a %s URL with a host", strings.Join(schemes, " or "))
+	}
+}
+
+func validateHTTPURL(raw string) error {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("%q must be an http or https URL", raw)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("%q has no host", raw)
+	}
+	return nil
+}
+
+// Policy converts the rules, failing if a CIDR doesn't parse.
+func (r EgressRules) Policy() (*egress.Policy, error) {
+	allowCIDRs, err := egress.ParseCIDRs(r.AllowCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %w", err)
+	}
+	denyCIDRs, err := egress.ParseCIDRs(r.DenyCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %w", err)
+	}
+	return &egress.Policy{
+		Schemes:        r.Schemes,
+		AllowHosts:     r.AllowHosts,
+		DenyHosts:      r.DenyHosts,
+		AllowCIDRs:     allowCIDRs,
+		DenyCIDRs:      denyCIDRs,
+		AllowPrivate:   r.AllowPrivate,
+		AllowLinkLocal: r.AllowLinkLocal,
+	}, nil
+}
+
+// WebhookClient builds the client webhooks are called with, limited by the webhook egress rules.
+// Rules that don't parse, which Validate reports, fall back to the default policy.
+func (c Config) WebhookClient() *http.Client {
+	policy, err := c.Egress.Webhooks.Policy()
+	if err != nil {
+		policy = &egress.Policy{}
+	}
+	return policy.Client(c.Timeouts.Webhook)
+}
+
+// ForwardClient builds the client events are forwarded and errors reported with, limited by the pipeline egress rules.
+func (c Config) ForwardClient() *http.Client {
+	policy, err := c.Egress.Pipeline.Policy()
+	if err != nil {
+		policy = &egress.Policy{}
+	}
+	return policy.Client(c.Timeouts.Forward)
+}
+
+// DestinationRegistry builds the named destinations. They are set by whoever runs the server rather than taken
+// from events, so they are called with the pipeline egress rules.
+func (c Config) DestinationRegistry() *destination.Registry {
+	return c.UpdateDestinations(Config{}, nil)
+}
+
+// UpdateDestinations builds the destinations after a reload from previous. Those whose settings have not changed
+// are taken from running, so they keep their connections and the digests they are collecting.
+func (c Config) UpdateDestinations(previous Config, running *destination.Registry) *destination.Registry {
+	policy, err := c.Egress.Pipeline.Policy()
+	if err != nil {
+		policy = &egress.Policy{}
+	}
+	client := policy.Client(c.Timeouts.Webhook)
+	sameClient := reflect.DeepEqual(c.Egress.Pipeline, previous.Egress.Pipeline) && c.Timeouts.Webhook == previous.Timeouts.Webhook
+
+	destinations := make(map[string]destination.Destination, len(c.Destinations))
+	for name, config := range c.Destinations {
+		if old, ok := previous.Destinations[name]; ok && sameClient && reflect.DeepEqual(old, config) {
+			if target, err := running.Lookup(destination.Prefix + name); err == nil {
+				destinations[name] = target
+				continue
+			}
+		}
+		target, err := newDestination(name, config, client)
+		if err != nil {
+			// Validate reports this, so it only happens to configs that weren't validated.
+			slog.Error("Skipping invalid destination", "destination", name, "error", err)
+			continue
+		}
+		destinations[name] = destination.Limited(target, destination.RateLimit{
+			PerSecond: config.RateLimit.PerSecond,
+			Burst:     config.RateLimit.Burst,
+		})
+	}
+	return destination.NewRegistry(destinations)
+}
+
+func newDestination(name string, config DestinationConfig, client *http.Client) (destination.Destination, error) {
+	switch config.Type {
+	case DestinationSlack:
+		return destination.Slack(name, config.URL, client), nil
+	case DestinationTeams:
+		return destination.Teams(name, config.URL, client), nil
+	case DestinationDiscord:
+		return destination.Discord(name, config.URL, client), nil
+	case DestinationEmail:
+		return destination.NewEmail(name, destination.EmailSettings{
+			Addr:         net.JoinHostPort(config.Email.Host, strconv.Itoa(config.Email.Port)),
+			From:         config.Email.From,
+			To:           config.Email.To,
+			Username:     config.Email.Username,
+			Password:     config.Email.Password,
+			Security:     config.Email.Security,
+			Subject:      config.Email.Subject,
+			Body:         config.Email.Body,
+			DigestWindow: config.Email.DigestWindow,
+			DigestMax:    config.Email.DigestMax,
+			Timeout:      client.Timeout,
+		})
+	case DestinationKafka:
+		settings := destination.KafkaSettings{
+			Brokers:  config.Broker.Brokers,
+			Topic:    config.Broker.Topic,
+			Username: config.Broker.Username,
+			Password: config.Broker.Password,
+		}
+		if config.Broker.TLS {
+			settings.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		return destination.NewBroker(name, destination.NewKafkaPublisher(settings), config.Broker.Payload)
+	case DestinationNATS:
+		return destination.NewBroker(name, destination.NewNATSPublisher(config.URL, config.Broker.Topic), config.Broker.Payload)
+	case DestinationAMQP:
+		publisher := destination.NewAMQPPublisher(config.URL, config.Broker.Exchange, config.Broker.Topic)
+		return destination.NewBroker(name, publisher, config.Broker.Payload)
+	}
+	header := http.Header{}
+	for key, value := range config.Headers {
+		header.Set(key, value)
+	}
+	return &destination.HTTP{
+		Name:        name,
+		URL:         config.URL,
+		Method:      strings.ToUpper(config.Method),
+		Header:      header,
+		BearerToken: config.Auth.BearerToken,
+		Username:    config.Auth.Username,
+		Password:    config.Auth.Password,
+		Client:      client,
+	}, nil
+}
+
+// RetryPolicy converts the retry settings for the server.
+func (c Config) RetryPolicy() helpers.RetryPolicy {
+	return helpers.RetryPolicy{
+		WebhookAttempts: c.Retries.WebhookAttempts,
+		ForwardAttempts: c.Retries.ForwardAttempts,
+		Backoff:         c.Retries.Backoff,
+	}
+}
+
+// ReadyProbeMap maps each ready probe's name to its URL, as server.WithReadyProbes takes them.
+func (c Config) ReadyProbeMap() map[string]string {
+	if len(c.ReadyProbes) == 0 {
+		return nil
+	}
+	probes := make(map[string]string, len(c.ReadyProbes))
+	for _, probe := range c.ReadyProbes {
+		if name, target, ok := strings.Cut(probe, "="); ok {
+			probes[name] = target
+		}
+	}
+	return probes
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// restartOnly lists the sections that are only read at startup. Changes to them are reported by a reload,
+// but the running values are kept until the next restart.
+var restartOnly = []string{"listen", "tls", "state", "ingest", "shutdown", "tracing"}
+
+func requiresRestart(key string) bool {
+	for _, section := range restartOnly {
+		if key == section || strings.HasPrefix(key, section+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Change is a setting that differs between two configs. The values are redacted.
+type Change struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// Diff lists the settings that differ between old and updated, sorted by key.
+func Diff(old Config, updated Config) []Change {
+	oldValues, updatedValues := flatten(old), flatten(updated)
+	oldShown, updatedShown := flatten(old.Redacted()), flatten(updated.Redacted())
+
+	var changes []Change
+	for key := range unionKeys(oldValues, updatedValues) {
+		if !reflect.DeepEqual(oldValues[key], updatedValues[key]) {
+			changes = append(changes, Change{Key: key, Old: oldShown[key], New: updatedShown[key]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+func unionKeys(a map[string]interface{}, b map[string]interface{}) map[string]struct{} {
+	keys := make(map[string]struct{}, len(a))
+	for key := range a {
+		keys[key] = struct{}{}
+	}
+	for key := range b {
+		keys[key] = struct{}{}
+	}
+	return keys
+}
+
+// keepRestartOnly copies the sections that can't change at runtime from running into updated.
+func keepRestartOnly(updated *Config, running Config) {
+	updated.Listen = running.Listen
+	updated.TLS = running.TLS
+	updated.State = running.State
+	updated.Ingest = running.Ingest
+	updated.Shutdown = running.Shutdown
+	updated.Tracing = running.Tracing
+}
+
+// Reloader re-reads the config and hands valid changes to apply. An invalid config is rejected,
+// and the previous one stays active.
+type Reloader struct {
+	v       *viper.Viper
+	apply   func(Config)
+	lock    sync.Mutex
+	current Config
+}
+
+// NewReloader starts from current, the config the server was started with.
+// apply is called with the complete new config after every reload that changes something.
+func NewReloader(v *viper.Viper, current Config, apply func(Config)) *Reloader {
+	return &Reloader{v: v, current: current, apply: apply}
+}
+
+// Current returns the config in effect.
+func (r *Reloader) Current() Config {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.current
+}
+
+// Reload re-reads the config file, if there is one, along with the environment and flags.
+// Returns an error if the new config was rejected.
+func (r *Reloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if path := r.v.ConfigFileUsed(); path != "" {
+		if err := r.v.ReadInConfig(); err != nil {
+			slog.Error("Rejected config reload, keeping the previous config", "path", path, "error", err)
+			return err
+		}
+	}
+	updated, err := Load(r.v)
+	if err != nil {
+		slog.Error("Rejected config reload, keeping the previous config", "error", err)
+		return err
+	}
+
+	applied := 0
+	for _, change := range Diff(r.current, updated) {
+		if requiresRestart(change.Key) {
+			slog.Warn("Config change needs a restart to take effect", "key", change.Key, "old", change.Old, "new", change.New)
+			continue
+		}
+		slog.Info("Config changed", "key", change.Key, "old", change.Old, "new", change.New)
+		applied++
+	}
+	if applied == 0 {
+		slog.Debug("Config reloaded without changes")
+		return nil
+	}
+
+	keepRestartOnly(&updated, r.current)
+	r.current = updated
+	r.apply(updated)
+	slog.Info("Config reloaded", "changes", applied)
+	return nil
+}
+
+// Watch reloads whenever the config file changes, until ctx is done. It does nothing if no config file is in use.
+// Changes go through Reload, so they are read under the same lock as a SIGHUP. Viper's own watcher would read
+// the file on its goroutine without it.
+func (r *Reloader) Watch(ctx context.Context) error {
+	path := r.v.ConfigFileUsed()
+	if path == "" {
+		return nil
+	}
+	file := filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watching config file: %w", err)
+	}
+	// Watch the directory, so a file replaced by an editor, or through a symlink as Kubernetes does, is followed.
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("watching config file: %w", err)
+	}
+	target, _ := filepath.EvalSymlinks(file)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				current, _ := filepath.EvalSymlinks(file)
+				written := filepath.Clean(event.Name) == file && event.Has(fsnotify.Write|fsnotify.Create)
+				if !written && (current == "" || current == target) {
+					continue
+				}
+				target = current
+				_ = r.Reload()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching config file", "path", file, "error", err)
+			}
+		}
+	}()
+	return nil
+}
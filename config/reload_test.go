@@ -0,0 +1,181 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/spf13/viper"
+)
+
+func newFileReloader(t *testing.T, file string) (*Reloader, string, *[]Config) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, file)
+
+	v := viper.New()
+	Bind(v)
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatalf("reading config: %s", err)
+	}
+	current, err := Load(v)
+	if err != nil {
+		t.Fatalf("loading config: %s", err)
+	}
+
+	var applied []Config
+	reloader := NewReloader(v, current, func(updated Config) { applied = append(applied, updated) })
+	return reloader, path, &applied
+}
+
+func writeConfig(t *testing.T, path string, file string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+}
+
+func TestReloadAppliesChanges(t *testing.T) {
+	reloader, path, applied := newFileReloader(t, "retries:\n  backoff: 250ms\n")
+
+	writeConfig(t, path, "retries:\n  backoff: 1s\nlogging:\n  level: debug\n")
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("expected the reload to succeed, got %s", err)
+	}
+	if len(*applied) != 1 {
+		t.Fatalf("expected the new config to be applied once, got %d", len(*applied))
+	}
+	if got := reloader.Current(); got.Retries.Backoff != time.Second || got.Logging.Level != "debug" {
+		t.Errorf("expected the new backoff and log level, got %s and %s", got.Retries.Backoff, got.Logging.Level)
+	}
+
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("expected an unchanged reload to succeed, got %s", err)
+	}
+	if len(*applied) != 1 {
+		t.Errorf("expected an unchanged config not to be applied again, got %d applies", len(*applied))
+	}
+}
+
+func TestReloadRejectsInvalidConfig(t *testing.T) {
+	reloader, path, applied := newFileReloader(t, "retries:\n  backoff: 250ms\n")
+
+	writeConfig(t, path, "retries:\n  backoff: 1s\n  forward_attempts: 0\n")
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("expected an invalid config to be rejected")
+	}
+	writeConfig(t, path, "retries: [not, a, map")
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("expected a config that doesn't parse to be rejected")
+	}
+	if len(*applied) != 0 {
+		t.Errorf("expected nothing to be applied, got %d applies", len(*applied))
+	}
+	if got := reloader.Current().Retries.Backoff; got != 250*time.Millisecond {
+		t.Errorf("expected the previous config to stay active, got backoff %s", got)
+	}
+}
+
+func TestReloadKeepsRestartOnlySettings(t *testing.T) {
+	reloader, path, applied := newFileReloader(t, "listen:\n  port: 9000\n")
+
+	writeConfig(t, path, "listen:\n  port: 9001\nretries:\n  webhook_attempts: 2\n")
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("expected the reload to succeed, got %s", err)
+	}
+	if len(*applied) != 1 {
+		t.Fatalf("expected the new config to be applied once, got %d", len(*applied))
+	}
+	if got := (*applied)[0]; got.Listen.Port != 9000 || got.Retries.WebhookAttempts != 2 {
+		t.Errorf("expected port 9000 to be kept and 2 webhook attempts applied, got port %d and %d attempts", got.Listen.Port, got.Retries.WebhookAttempts)
+	}
+}
+
+func TestWatchReloadsAlongsideSIGHUP(t *testing.T) {
+	reloader, path, _ := newFileReloader(t, "retries:\n  webhook_attempts: 1\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := reloader.Watch(ctx); err != nil {
+		t.Fatalf("watching config: %s", err)
+	}
+
+	// Reloads from the watcher and from SIGHUP read the same viper, which only works if they take turns.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			_ = reloader.Reload()
+		}
+	}()
+	for attempts := 2; attempts <= 5; attempts++ {
+		writeConfig(t, path, fmt.Sprintf("retries:\n  webhook_attempts: %d\n", attempts))
+	}
+	wg.Wait()
+
+	// Nothing else reloads from here on, so only the watcher can pick this up.
+	writeConfig(t, path, "retries:\n  webhook_attempts: 6\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for reloader.Current().Retries.WebhookAttempts != 6 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the watcher to reload the last write, got %d webhook attempts", reloader.Current().Retries.WebhookAttempts)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiffRedacts(t *testing.T) {
+	old := Default()
+	updated := Default()
+	updated.Credentials.BearerTokens = []string{"s3cr3t-value"}
+
+	changes := Diff(old, updated)
+	if len(changes) != 1 || changes[0].Key != "credentials.bearer_tokens" {
+		t.Fatalf("expected a single credentials change, got %+v", changes)
+	}
+	if shown, ok := changes[0].New.([]interface{}); ok && len(shown) == 1 && shown[0] == "s3cr3t-value" {
+		t.Errorf("expected the new token to be redacted, got %v", changes[0].New)
+	}
+}
+
+func TestUpdateDestinationsKeepsUnchanged(t *testing.T) {
+	previous := Default()
+	previous.Destinations = map[string]DestinationConfig{
+		"oncall": {URL: "https://hooks.example.com/oncall"},
+		"audit":  {URL: "https://hooks.example.com/audit"},
+	}
+	running := previous.DestinationRegistry()
+
+	updated := previous
+	updated.Logging.Level = "debug"
+	updated.Destinations = map[string]DestinationConfig{
+		"oncall": {URL: "https://hooks.example.com/oncall"},
+		"audit":  {URL: "https://hooks.example.com/audit-v2"},
+	}
+	registry := updated.UpdateDestinations(previous, running)
+
+	lookup := func(registry *destination.Registry, name string) destination.Destination {
+		target, err := registry.Lookup(destination.Prefix + name)
+		if err != nil {
+			t.Fatalf("looking up %s: %s", name, err)
+		}
+		return target
+	}
+	if lookup(registry, "oncall") != lookup(running, "oncall") {
+		t.Error("expected the unchanged destination to be carried over")
+	}
+	if lookup(registry, "audit") == lookup(running, "audit") {
+		t.Error("expected the changed destination to be rebuilt")
+	}
+
+	updated.Timeouts.Webhook++
+	if lookup(updated.UpdateDestinations(previous, running), "oncall") == lookup(running, "oncall") {
+		t.Error("expected a new webhook timeout to rebuild every destination")
+	}
+}
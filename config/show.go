@@ -0,0 +1,182 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "xxxxx"
+
+// mysqlPassword matches the password of a MySQL DSN, e.g. user:password@tcp(host:3306)/db
+var mysqlPassword = regexp.MustCompile(`^([^:@/]*):[^@]*@`)
+
+// Redacted returns a copy of the config with passwords, tokens and header values replaced, so it can be shown or logged.
+func (c Config) Redacted() Config {
+	c.State.DBURL = redactURL(c.State.DBURL)
+	if c.ReadyProbes != nil {
+		probes := make([]string, len(c.ReadyProbes))
+		for i, probe := range c.ReadyProbes {
+			if name, target, ok := strings.Cut(probe, "="); ok {
+				probes[i] = name + "=" + redactURL(target)
+			} else {
+				probes[i] = redactURL(probe)
+			}
+		}
+		c.ReadyProbes = probes
+	}
+	if c.Ingest.BatchEndpoints != nil {
+		endpoints := make([]BatchEndpointConfig, len(c.Ingest.BatchEndpoints))
+		for i, endpoint := range c.Ingest.BatchEndpoints {
+			endpoints[i] = BatchEndpointConfig{Next: redactURL(endpoint.Next), Batch: redactURL(endpoint.Batch)}
+		}
+		c.Ingest.BatchEndpoints = endpoints
+	}
+
+	c.Credentials.BearerTokens = redactAll(c.Credentials.BearerTokens)
+	c.Credentials.HMACSecrets = redactAll(c.Credentials.HMACSecrets)
+
+	if c.Destinations != nil {
+		destinations := make(map[string]DestinationConfig, len(c.Destinations))
+		for name, destination := range c.Destinations {
+			switch destination.Type {
+			case DestinationSlack, DestinationTeams, DestinationDiscord:
+				// Chat webhook URLs carry their secret in the path, or for Teams in the query as well.
+				destination.URL = redactPath(destination.URL)
+			default:
+				destination.URL = redactURL(destination.URL)
+			}
+			destination.Auth.BearerToken = redact(destination.Auth.BearerToken)
+			destination.Auth.Password = redact(destination.Auth.Password)
+			destination.Email.Password = redact(destination.Email.Password)
+			destination.Broker.Password = redact(destination.Broker.Password)
+			if destination.Headers != nil {
+				headers := make(map[string]string, len(destination.Headers))
+				for header := range destination.Headers {
+					headers[header] = redacted
+				}
+				destination.Headers = headers
+			}
+			destinations[name] = destination
+		}
+		c.Destinations = destinations
+	}
+	return c
+}
+
+// redactURL is used for every URL in the config. It hides the password, or a username given on its own,
+// and drops the query and fragment, which often carry tokens such as ?token=.
+func redactURL(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	if !strings.Contains(raw, "://") {
+		dsn, _, _ := strings.Cut(raw, "?")
+		return mysqlPassword.ReplaceAllString(dsn, "${1}:"+redacted+"@")
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		// Can't tell which part is secret, so hide all of it.
+		return redacted
+	}
+	if _, ok := parsed.User.Password(); ok {
+		parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+	} else if parsed.User != nil {
+		// A username on its own is often a token, as in nats://token@host.
+		parsed.User = url.User(redacted)
+	}
+	parsed.RawQuery, parsed.ForceQuery = "", false
+	parsed.Fragment, parsed.RawFragment = "", ""
+	return parsed.String()
+}
+
+// redactPath keeps only the scheme and host of a URL whose path and query are secret.
+func redactPath(raw string) string {
+	if raw == "" {
+		return raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return redacted
+	}
+	return (&url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: "/" + redacted}).String()
+}
+
+func redactAll(secrets []string) []string {
+	if secrets == nil {
+		return nil
+	}
+	hidden := make([]string, len(secrets))
+	for i := range secrets {
+		hidden[i] = redacted
+	}
+	return hidden
+}
+
+// YAML renders the config in the format of the config file, with durations written as e.g. 30s.
+func (c Config) YAML() ([]byte, error) {
+	return yaml.Marshal(toPlain(reflect.ValueOf(c)))
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// toPlain converts a config value into maps, slices and scalars keyed by their mapstructure names.
+func toPlain(value reflect.Value) interface{} {
+	if value.Type() == durationType {
+		return time.Duration(value.Int()).String()
+	}
+	switch value.Kind() {
+	case reflect.Struct:
+		plain := make(map[string]interface{}, value.NumField())
+		for i := 0; i < value.NumField(); i++ {
+			plain[value.Type().Field(i).Tag.Get("mapstructure")] = toPlain(value.Field(i))
+		}
+		return plain
+	case reflect.Map:
+		plain := make(map[string]interface{}, value.Len())
+		for _, key := range value.MapKeys() {
+			plain[key.String()] = toPlain(value.MapIndex(key))
+		}
+		return plain
+	case reflect.Slice:
+		plain := make([]interface{}, value.Len())
+		for i := range plain {
+			plain[i] = toPlain(value.Index(i))
+		}
+		return plain
+	default:
+		return value.Interface()
+	}
+}
+
+// flatten lists the leaf settings of the config by their dotted keys, e.g. listen.port. Unset maps and slices are left out.
+func flatten(c Config) map[string]interface{} {
+	flat := make(map[string]interface{})
+	var walk func(prefix string, value reflect.Value)
+	walk = func(prefix string, value reflect.Value) {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Field(i)
+			key := prefix + value.Type().Field(i).Tag.Get("mapstructure")
+			switch {
+			case field.Kind() == reflect.Struct:
+				walk(key+".", field)
+			case (field.Kind() == reflect.Map || field.Kind() == reflect.Slice) && field.IsNil():
+			default:
+				flat[key] = field.Interface()
+			}
+		}
+	}
+	walk("", reflect.ValueOf(c))
+	return flat
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
@@ -0,0 +1,344 @@
+package destination_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+)
+
+type fakeDelivery struct {
+	Exchange      string
+	RoutingKey    string
+	ContentType   string
+	Headers       map[string]string
+	DeliveryMode  byte
+	MessageID     string
+	CorrelationID string
+	Body          string
+	Auth          string
+	Vhost         string
+}
+
+// fakeAMQP is just enough of an AMQP 0-9-1 broker for amqp091-go: the connection handshake with PLAIN auth,
+// channels, publisher confirms, and publishing. Each publish is acknowledged, except that nacks are sent for
+// the first nacks publishes, as a broker does when it can't take a message.
+type fakeAMQP struct {
+	URL      string
+	received chan fakeDelivery
+
+	lock        sync.Mutex
+	nacks       int
+	connections int
+}
+
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+	amqpFrameEnd    = 0xCE
+)
+
+func newFakeAMQP(t *testing.T, nacks int) *fakeAMQP {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	broker := &fakeAMQP{URL: "amqp://user:pass@" + listener.Addr().String() + "/alerting", received: make(chan fakeDelivery, 10), nacks: nacks}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return broker
+}
+
+// amqpWriter builds method arguments in the AMQP encoding.
+type amqpWriter struct{ bytes.Buffer }
+
+func (w *amqpWriter) octet(b byte)      { w.WriteByte(b) }
+func (w *amqpWriter) short(v uint16)    { _ = binary.Write(w, binary.BigEndian, v) }
+func (w *amqpWriter) long(v uint32)     { _ = binary.Write(w, binary.BigEndian, v) }
+func (w *amqpWriter) longlong(v uint64) { _ = binary.Write(w, binary.BigEndian, v) }
+func (w *amqpWriter) shortstr(s string) {
+	w.octet(byte(len(s)))
+	w.WriteString(s)
+}
+func (w *amqpWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+// amqpReader reads method arguments, remembering the first error.
+type amqpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *amqpReader) next(n int) []byte {
+	if r.err != nil || len(r.data) < n {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+func (r *amqpReader) octet() byte      { return r.next(1)[0] }
+func (r *amqpReader) short() uint16    { return binary.BigEndian.Uint16(r.next(2)) }
+func (r *amqpReader) long() uint32     { return binary.BigEndian.Uint32(r.next(4)) }
+func (r *amqpReader) longlong() uint64 { return binary.BigEndian.Uint64(r.next(8)) }
+func (r *amqpReader) shortstr() string { return string(r.next(int(r.octet()))) }
+func (r *amqpReader) longstr() string  { return string(r.next(int(r.long()))) }
+
+// table reads a field table, keeping the string values, which is all the publisher sends.
+func (r *amqpReader) table() map[string]string {
+	fields := &amqpReader{data: r.next(int(r.long()))}
+	values := map[string]string{}
+	for len(fields.data) > 0 && fields.err == nil {
+		key := fields.shortstr()
+		switch kind := fields.octet(); kind {
+		case 'S':
+			values[key] = fields.longstr()
+		case 'F':
+			fields.table()
+		case 't':
+			fields.octet()
+		default:
+			r.err = fmt.Errorf("unexpected field type %c", kind)
+			return values
+		}
+	}
+	return values
+}
+
+func writeAMQPFrame(w io.Writer, kind byte, channel uint16, payload []byte) error {
+	var frame amqpWriter
+	frame.octet(kind)
+	frame.short(channel)
+	frame.long(uint32(len(payload)))
+	frame.Write(payload)
+	frame.octet(amqpFrameEnd)
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+func writeAMQPMethod(w io.Writer, channel uint16, class uint16, method uint16, args func(*amqpWriter)) error {
+	var payload amqpWriter
+	payload.short(class)
+	payload.short(method)
+	if args != nil {
+		args(&payload)
+	}
+	return writeAMQPFrame(w, amqpFrameMethod, channel, payload.Bytes())
+}
+
+func readAMQPFrame(r *bufio.Reader) (kind byte, channel uint16, payload []byte, err error) {
+	header := make([]byte, 7)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	kind, channel = header[0], binary.BigEndian.Uint16(header[1:3])
+	payload = make([]byte, binary.BigEndian.Uint32(header[3:7])+1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if payload[len(payload)-1] != amqpFrameEnd {
+		err = fmt.Errorf("missing frame end")
+	}
+	return kind, channel, payload[:len(payload)-1], err
+}
+
+func (b *fakeAMQP) serve(conn net.Conn) {
+	defer conn.Close()
+	b.lock.Lock()
+	b.connections++
+	b.lock.Unlock()
+
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	_ = writeAMQPMethod(conn, 0, 10, 10, func(w *amqpWriter) { // connection.start
+		w.octet(0)
+		w.octet(9)
+		w.long(0) // No server properties
+		w.longstr("PLAIN")
+		w.longstr("en_US")
+	})
+
+	var auth, vhost string
+	var delivery *fakeDelivery
+	var bodySize uint64
+	deliveryTags := map[uint16]uint64{}
+	for {
+		kind, channel, payload, err := readAMQPFrame(reader)
+		if err != nil {
+			return
+		}
+		args := &amqpReader{data: payload}
+		switch kind {
+		case amqpFrameMethod:
+			class, method := args.short(), args.short()
+			switch {
+			case class == 10 && method == 11: // connection.start-ok
+				args.table()
+				args.shortstr()
+				auth = args.longstr()
+				_ = writeAMQPMethod(conn, 0, 10, 30, func(w *amqpWriter) { // connection.tune
+					w.short(0)
+					w.long(131072)
+					w.short(0)
+				})
+			case class == 10 && method == 31: // connection.tune-ok
+			case class == 10 && method == 40: // connection.open
+				vhost = args.shortstr()
+				_ = writeAMQPMethod(conn, 0, 10, 41, func(w *amqpWriter) { w.shortstr("") })
+			case class == 10 && method == 50: // connection.close
+				_ = writeAMQPMethod(conn, 0, 10, 51, nil)
+				return
+			case class == 20 && method == 10: // channel.open
+				_ = writeAMQPMethod(conn, channel, 20, 11, func(w *amqpWriter) { w.longstr("") })
+			case class == 20 && method == 40: // channel.close
+				_ = writeAMQPMethod(conn, channel, 20, 41, nil)
+			case class == 85 && method == 10: // confirm.select
+				_ = writeAMQPMethod(conn, channel, 85, 11, nil)
+			case class == 60 && method == 40: // basic.publish
+				args.short()
+				delivery = &fakeDelivery{Exchange: args.shortstr(), RoutingKey: args.shortstr(), Auth: auth, Vhost: vhost}
+			default:
+				return
+			}
+		case amqpFrameHeader:
+			args.short() // Class
+			args.short() // Weight
+			bodySize = args.longlong()
+			flags := args.short()
+			if flags&(1<<15) != 0 {
+				delivery.ContentType = args.shortstr()
+			}
+			if flags&(1<<14) != 0 {
+				args.shortstr()
+			}
+			if flags&(1<<13) != 0 {
+				delivery.Headers = args.table()
+			}
+			if flags&(1<<12) != 0 {
+				delivery.DeliveryMode = args.octet()
+			}
+			if flags&(1<<11) != 0 {
+				args.octet()
+			}
+			if flags&(1<<10) != 0 {
+				delivery.CorrelationID = args.shortstr()
+			}
+			for bit := uint16(9); bit >= 8; bit-- {
+				if flags&(1<<bit) != 0 {
+					args.shortstr()
+				}
+			}
+			if flags&(1<<7) != 0 {
+				delivery.MessageID = args.shortstr()
+			}
+			if args.err != nil {
+				return
+			}
+		case amqpFrameBody:
+			delivery.Body += string(payload)
+		}
+
+		if delivery != nil && kind != amqpFrameMethod && uint64(len(delivery.Body)) == bodySize {
+			deliveryTags[channel]++
+			b.lock.Lock()
+			nack := b.nacks > 0
+			b.nacks--
+			b.lock.Unlock()
+			tag := deliveryTags[channel]
+			if nack {
+				_ = writeAMQPMethod(conn, channel, 60, 120, func(w *amqpWriter) { w.longlong(tag); w.octet(0) })
+			} else {
+				b.received <- *delivery
+				_ = writeAMQPMethod(conn, channel, 60, 80, func(w *amqpWriter) { w.longlong(tag); w.octet(0) })
+			}
+			delivery = nil
+		}
+	}
+}
+
+func (b *fakeAMQP) connectionCount() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.connections
+}
+
+func TestAMQPPublisher(t *testing.T) {
+	broker := newFakeAMQP(t, 1)
+	publisher := destination.NewAMQPPublisher(broker.URL, "alerts", "matches")
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	message := destination.BrokerMessage{Key: "q1", Body: []byte(`{"query_id":"q1"}`), Headers: map[string]string{"step": "2"}}
+	if err := publisher.Publish(ctx, message); err == nil {
+		t.Fatal("expected a message the broker nacked to fail")
+	}
+	if err := publisher.Publish(ctx, message); err != nil {
+		t.Fatalf("expected publishing on a new connection to work, got %s", err)
+	}
+	if count := broker.connectionCount(); count != 2 {
+		t.Errorf("expected to reconnect after the failed publish, got %d connections", count)
+	}
+
+	var messageID string
+	select {
+	case delivery := <-broker.received:
+		if delivery.Auth != "\x00user\x00pass" || delivery.Vhost != "alerting" {
+			t.Errorf("expected the credentials and vhost from the URL, got %q and %q", delivery.Auth, delivery.Vhost)
+		}
+		if delivery.Exchange != "alerts" || delivery.RoutingKey != "matches" || delivery.Body != `{"query_id":"q1"}` {
+			t.Errorf("expected the message on the exchange, got %+v", delivery)
+		}
+		if delivery.Headers["step"] != "2" || delivery.DeliveryMode != 2 || delivery.ContentType != "application/json" {
+			t.Errorf("expected a persistent JSON message with its headers, got %+v", delivery)
+		}
+		if delivery.CorrelationID != "q1" || delivery.MessageID == "" || delivery.MessageID == "q1" {
+			t.Errorf("expected the query as correlation ID and a message ID of its own, got %+v", delivery)
+		}
+		messageID = delivery.MessageID
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+
+	// Publishing the same match again is a new message to the broker.
+	if err := publisher.Publish(ctx, message); err != nil {
+		t.Fatalf("publishing again: %s", err)
+	}
+	select {
+	case delivery := <-broker.received:
+		if delivery.CorrelationID != "q1" || delivery.MessageID == messageID {
+			t.Errorf("expected a new message ID for the same query, got %q after %q", delivery.MessageID, messageID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+
+	_ = publisher.Close()
+	if err := publisher.Publish(ctx, message); err == nil {
+		t.Error("expected publishing after closing to fail")
+	}
+}
@@ -0,0 +1,111 @@
+package destination
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// BrokerMessage is a notification ready to be published.
+type BrokerMessage struct {
+	// Key is the query ID, which Kafka uses to keep the matches of a query in order on one partition.
+	Key     string
+	Body    []byte
+	Headers map[string]string
+}
+
+// Publisher delivers messages to a topic, subject or exchange of a message broker.
+// Publish returns once the broker has accepted the message.
+type Publisher interface {
+	Publish(ctx context.Context, message BrokerMessage) error
+	Close() error
+}
+
+// PayloadData is what a broker payload template is executed with.
+type PayloadData struct {
+	Notification
+	Message Message
+}
+
+// Broker publishes notifications to a message broker, as the same JSON an HTTP destination would POST, or as
+// the output of a template.
+type Broker struct {
+	name      string
+	publisher Publisher
+	payload   *template.Template
+}
+
+// ParsePayloadTemplate checks a broker payload template. Empty means the default JSON payload.
+func ParsePayloadTemplate(payload string) (*template.Template, error) {
+	if payload == "" {
+		return nil, nil
+	}
+	return template.New("payload").Parse(payload)
+}
+
+func NewBroker(name string, publisher Publisher, payload string) (*Broker, error) {
+	payloadTemplate, err := ParsePayloadTemplate(payload)
+	if err != nil {
+		return nil, fmt.Errorf("payload: %w", err)
+	}
+	return &Broker{name: name, publisher: publisher, payload: payloadTemplate}, nil
+}
+
+func (b *Broker) Send(ctx context.Context, notification Notification) error {
+	ctx, span := tracing.Tracer().Start(ctx, "Publish")
+	defer span.End()
+
+	body, err := b.render(notification)
+	if err != nil {
+		tracing.RecordError(span, err)
+		return err
+	}
+	// Consumers can pick the trace up from the headers, as the next step does from HTTP headers.
+	carrier := http.Header{}
+	tracing.Inject(ctx, carrier)
+	headers := map[string]string{
+		"query_id": notification.QueryID,
+		"step":     strconv.Itoa(notification.Step),
+	}
+	for key := range carrier {
+		headers[key] = carrier.Get(key)
+	}
+
+	err = b.publisher.Publish(ctx, BrokerMessage{Key: notification.QueryID, Body: body, Headers: headers})
+	if err != nil {
+		metrics.WebhookSends.WithLabelValues(metrics.Destination(b.name), "error").Inc()
+		tracing.RecordError(span, err)
+		return fmt.Errorf("publishing to %s: %w", b.name, err)
+	}
+	metrics.WebhookSends.WithLabelValues(metrics.Destination(b.name), "published").Inc()
+	return nil
+}
+
+func (b *Broker) render(notification Notification) ([]byte, error) {
+	if b.payload == nil {
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+		return json.Marshal(httpBody{
+			QueryID:   notification.QueryID,
+			Step:      notification.Step,
+			Condition: notification.Condition,
+			Event:     notification.Event,
+		})
+	}
+	var payload bytes.Buffer
+	if err := b.payload.Execute(&payload, PayloadData{Notification: notification, Message: NewMessage(notification)}); err != nil {
+		return nil, fmt.Errorf("rendering payload: %w", err)
+	}
+	return payload.Bytes(), nil
+}
+
+// Close closes the connection to the broker.
+func (b *Broker) Close() error {
+	return b.publisher.Close()
+}
@@ -0,0 +1,225 @@
+package destination_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+)
+
+type fakePublisher struct {
+	lock     sync.Mutex
+	messages []destination.BrokerMessage
+	err      error
+	closed   bool
+}
+
+func (p *fakePublisher) Publish(_ context.Context, message destination.BrokerMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.messages = append(p.messages, message)
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.closed = true
+	return nil
+}
+
+func (p *fakePublisher) isClosed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.closed
+}
+
+func TestBrokerPublishesEvent(t *testing.T) {
+	publisher := &fakePublisher{}
+	broker, err := destination.NewBroker("events", publisher, "")
+	if err != nil {
+		t.Fatalf("building broker destination: %s", err)
+	}
+	if err := broker.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("publishing: %s", err)
+	}
+
+	if len(publisher.messages) != 1 {
+		t.Fatalf("expected one message, got %d", len(publisher.messages))
+	}
+	message := publisher.messages[0]
+	if message.Key != "q1" || message.Headers["query_id"] != "q1" || message.Headers["step"] != "2" {
+		t.Errorf("expected the query to be the key and in the headers, got %q and %v", message.Key, message.Headers)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(message.Body, &body); err != nil {
+		t.Fatalf("expected a JSON body, got %s: %s", message.Body, err)
+	}
+	if body["query_id"] != "q1" || body["condition"] != "errors>=5" || body["event"] == nil {
+		t.Errorf("expected the same body an http destination sends, got %s", message.Body)
+	}
+}
+
+func TestBrokerPayloadTemplate(t *testing.T) {
+	publisher := &fakePublisher{}
+	broker, err := destination.NewBroker("events", publisher, `{{.QueryID}} {{.Condition}} {{index .Event.Derived "host"}} {{.Message.Title}}`)
+	if err != nil {
+		t.Fatalf("building broker destination: %s", err)
+	}
+	if err := broker.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("publishing: %s", err)
+	}
+	if body := string(publisher.messages[0].Body); body != "q1 errors>=5 web-1 Condition errors>=5 matched" {
+		t.Errorf("expected the rendered template, got %q", body)
+	}
+
+	if _, err := destination.NewBroker("events", publisher, "{{.Missing"); err == nil {
+		t.Error("expected a broken template to be rejected")
+	}
+}
+
+func TestBrokerErrorsAndClose(t *testing.T) {
+	publisher := &fakePublisher{err: errors.New("no leader for partition")}
+	broker, _ := destination.NewBroker("events", publisher, "")
+	if err := broker.Send(context.Background(), testNotification()); err == nil || !strings.Contains(err.Error(), "no leader") {
+		t.Errorf("expected the publish error, got %v", err)
+	}
+
+	registry := destination.NewRegistry(map[string]destination.Destination{
+		"events": destination.Limited(broker, destination.RateLimit{PerSecond: 1}),
+	})
+	if err := registry.Close(context.Background()); err != nil || !publisher.isClosed() {
+		t.Errorf("expected closing the registry to close the publisher, got %v", err)
+	}
+}
+
+func TestRetireWaitsForHolds(t *testing.T) {
+	replacedPublisher, keptPublisher := &fakePublisher{}, &fakePublisher{}
+	replaced, _ := destination.NewBroker("replaced", replacedPublisher, "")
+	kept, _ := destination.NewBroker("kept", keptPublisher, "")
+	previous := destination.NewRegistry(map[string]destination.Destination{"replaced": replaced, "kept": kept})
+	next := destination.NewRegistry(map[string]destination.Destination{"kept": kept})
+
+	release := destination.Hold(destination.WithRegistry(context.Background(), previous))
+	retired := make(chan error, 1)
+	go func() { retired <- previous.Retire(context.Background(), next) }()
+
+	select {
+	case <-retired:
+		t.Fatal("expected Retire to wait for the hold to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// Work that started before the reload can still publish.
+	if err := replaced.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("expected the held destination to stay open, got %s", err)
+	}
+
+	release()
+	if err := <-retired; err != nil {
+		t.Fatalf("retiring: %s", err)
+	}
+	if !replacedPublisher.isClosed() || keptPublisher.isClosed() {
+		t.Errorf("expected only the destination not carried over to be closed, got replaced %t and kept %t",
+			replacedPublisher.isClosed(), keptPublisher.isClosed())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_ = next.Hold()
+	if err := next.Close(ctx); err == nil || !keptPublisher.isClosed() {
+		t.Errorf("expected Close to give up waiting when ctx expires and close anyway, got %v", err)
+	}
+}
+
+// fakeNATS is just enough of a NATS server for the client: the handshake, pings and publishing with headers.
+type fakeNATS struct {
+	URL      string
+	received chan string
+}
+
+func newFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	server := &fakeNATS{URL: "nats://" + listener.Addr().String(), received: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return server
+}
+
+func (s *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte(`INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576}` + "\r\n"))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			_, _ = conn.Write([]byte("PONG\r\n"))
+		case "PUB", "HPUB":
+			// The last field is the size of the headers and payload, followed by CRLF.
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			s.received <- fields[1] + " " + string(data[:size])
+		}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	server := newFakeNATS(t)
+	publisher := destination.NewNATSPublisher(server.URL, "webhooks.matches")
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := publisher.Publish(ctx, destination.BrokerMessage{Key: "q1", Body: []byte(`{"query_id":"q1"}`), Headers: map[string]string{"query_id": "q1"}})
+	if err != nil {
+		t.Fatalf("publishing: %s", err)
+	}
+	select {
+	case message := <-server.received:
+		if !strings.HasPrefix(message, "webhooks.matches ") || !strings.Contains(message, "query_id: q1") ||
+			!strings.HasSuffix(message, `{"query_id":"q1"}`) {
+			t.Errorf("expected the message with its headers on the subject, got %q", message)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+
+	_ = publisher.Close()
+	if err := publisher.Publish(ctx, destination.BrokerMessage{Key: "q1"}); err == nil {
+		t.Error("expected publishing after closing to fail")
+	}
+}
@@ -0,0 +1,174 @@
+package destination
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Chat posts a readable message to the incoming webhook of a chat tool. Build one with Slack, Teams or Discord.
+type Chat struct {
+	// Name is logged in place of the URL, which holds the webhook's secret.
+	Name string
+	URL  string
+	// Client defaults to the webhook client on ctx.
+	Client *http.Client
+	format func(Message) interface{}
+}
+
+// Slack posts to a Slack incoming webhook, using Block Kit.
+func Slack(name string, url string, client *http.Client) *Chat {
+	return &Chat{Name: name, URL: url, Client: client, format: slackMessage}
+}
+
+// Teams posts to a Microsoft Teams workflow or incoming webhook, as an Adaptive Card.
+func Teams(name string, url string, client *http.Client) *Chat {
+	return &Chat{Name: name, URL: url, Client: client, format: teamsMessage}
+}
+
+// Discord posts to a Discord webhook, as an embed.
+func Discord(name string, url string, client *http.Client) *Chat {
+	return &Chat{Name: name, URL: url, Client: client, format: discordMessage}
+}
+
+func (c *Chat) Send(ctx context.Context, notification Notification) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	body, err := json.Marshal(c.format(NewMessage(notification)))
+	if err != nil {
+		return err
+	}
+	if c.Client != nil {
+		ctx = helpers.WithWebhookClient(ctx, c.Client)
+	}
+	return helpers.SendWebhook(ctx, helpers.WebhookRequest{
+		Name:   c.Name,
+		Method: http.MethodPost,
+		URL:    c.URL,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   body,
+	})
+}
+
+// fallbackText is the plain text version of a message, shown in notifications and by clients without formatting.
+func fallbackText(message Message) string {
+	text := message.Title
+	for _, field := range message.Fields[:min(len(message.Fields), 2)] {
+		text += ", " + field.Name + " " + field.Value
+	}
+	return text
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+// slackEscaper escapes the characters Slack's mrkdwn gives a meaning, so values can't mention users or add links.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackMaxSection is the most text Slack takes in a section block.
+const slackMaxSection = 3000
+
+// slackEscapeTruncate escapes s and shortens the result to at most n runes, without leaving half of an entity behind.
+func slackEscapeTruncate(s string, n int) string {
+	escaped := slackEscaper.Replace(s)
+	if utf8.RuneCountInString(escaped) <= n {
+		return escaped
+	}
+	cut := string([]rune(escaped)[:n-1])
+	if amp := strings.LastIndexByte(cut, '&'); amp > strings.LastIndexByte(cut, ';') {
+		cut = cut[:amp]
+	}
+	return cut + "…"
+}
+
+func slackMessage(message Message) interface{} {
+	blocks := []slackBlock{{Type: "header", Text: &slackText{Type: "plain_text", Text: truncate(message.Title, 150)}}}
+	// Slack takes at most 10 fields per section.
+	for start := 0; start < len(message.Fields); start += 10 {
+		section := slackBlock{Type: "section"}
+		for _, field := range message.Fields[start:min(start+10, len(message.Fields))] {
+			section.Fields = append(section.Fields, slackText{Type: "mrkdwn", Text: "*" + slackEscaper.Replace(field.Name) + "*\n" + slackEscaper.Replace(field.Value)})
+		}
+		blocks = append(blocks, section)
+	}
+	if message.Raw != "" {
+		blocks = append(blocks, slackBlock{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "```" + slackEscapeTruncate(message.Raw, slackMaxSection-2*len("```")) + "```"}})
+	}
+	return map[string]interface{}{"text": slackEscaper.Replace(fallbackText(message)), "blocks": blocks}
+}
+
+type teamsFact struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+}
+
+func teamsMessage(message Message) interface{} {
+	facts := make([]teamsFact, 0, len(message.Fields))
+	for _, field := range message.Fields {
+		facts = append(facts, teamsFact{Title: field.Name, Value: field.Value})
+	}
+	body := []map[string]interface{}{
+		{"type": "TextBlock", "text": message.Title, "weight": "Bolder", "size": "Medium", "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if message.Raw != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": message.Raw, "fontType": "Monospace", "wrap": true})
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"summary": fallbackText(message),
+				"body":    body,
+			},
+		}},
+	}
+}
+
+type discordField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline"`
+}
+
+type discordEmbed struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Fields      []discordField `json:"fields"`
+	Timestamp   string         `json:"timestamp,omitempty"`
+}
+
+func discordMessage(message Message) interface{} {
+	embed := discordEmbed{Title: truncate(message.Title, 256)}
+	for _, field := range message.Fields {
+		// Discord rejects embeds with empty field values.
+		value := field.Value
+		if value == "" {
+			value = "-"
+		}
+		embed.Fields = append(embed.Fields, discordField{Name: truncate(field.Name, 256), Value: value, Inline: true})
+	}
+	if message.Raw != "" {
+		embed.Description = "```" + message.Raw + "```"
+	}
+	if message.Time != nil {
+		embed.Timestamp = message.Time.UTC().Format(time.RFC3339)
+	}
+	return map[string]interface{}{"embeds": []discordEmbed{embed}}
+}
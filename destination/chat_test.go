@@ -0,0 +1,171 @@
+package destination_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/webhooktest"
+)
+
+func testNotification() destination.Notification {
+	raw := "disk full on web-1"
+	eventType := "alert"
+	timestamp := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	return destination.Notification{
+		QueryID:   "q1",
+		Step:      2,
+		Condition: "errors>=5",
+		Event: go_system_api.EventData{
+			Raw:       &raw,
+			EventType: &eventType,
+			TimeStamp: &timestamp,
+			Derived:   map[string]interface{}{"errors": 7, "host": "web-1"},
+		},
+	}
+}
+
+// sendTo sends notification to a chat destination in front of a stand-in server, and returns the JSON it got.
+func sendTo(t *testing.T, build func(name string, url string, client *http.Client) *destination.Chat, notification destination.Notification) map[string]interface{} {
+	t.Helper()
+	target := webhooktest.NewRecorder(t)
+	chat := build("ops", target.Endpoint("/hook"), webhooktest.LoopbackClient())
+	if err := chat.Send(context.Background(), notification); err != nil {
+		t.Fatalf("sending: %s", err)
+	}
+	request := target.Wait(t)
+	if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON POST, got %s %s", request.Method, request.Header.Get("Content-Type"))
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		t.Fatalf("expected a JSON body, got %s: %s", request.Body, err)
+	}
+	return body
+}
+
+// contains reports whether the JSON encoding of body contains all of values.
+func contains(t *testing.T, body interface{}, values ...string) {
+	t.Helper()
+	encoded, _ := json.Marshal(body)
+	for _, value := range values {
+		if !strings.Contains(string(encoded), value) {
+			t.Errorf("expected %q in %s", value, encoded)
+		}
+	}
+}
+
+func TestSlack(t *testing.T) {
+	body := sendTo(t, destination.Slack, testNotification())
+	if text, _ := body["text"].(string); !strings.Contains(text, "errors&gt;=5") {
+		t.Errorf("expected a fallback text naming the condition, got %q", body["text"])
+	}
+	blocks, _ := body["blocks"].([]interface{})
+	if len(blocks) != 3 {
+		t.Fatalf("expected a header, a section of fields and the raw event, got %v", body["blocks"])
+	}
+	if header := blocks[0].(map[string]interface{}); header["type"] != "header" {
+		t.Errorf("expected the first block to be the header, got %v", header)
+	}
+	contains(t, blocks[1], `*Query*\nq1`, `*errors*\n7`, `*host*\nweb-1`)
+	contains(t, blocks[2], "```disk full on web-1```")
+
+	notification := testNotification()
+	notification.Event.Derived = map[string]interface{}{"<!channel> & co": "<https://evil.example.com|click>"}
+	body = sendTo(t, destination.Slack, notification)
+	fields := body["blocks"].([]interface{})[1].(map[string]interface{})["fields"].([]interface{})
+	escaped := "*&lt;!channel&gt; &amp; co*\n&lt;https://evil.example.com|click&gt;"
+	if text := fields[len(fields)-1].(map[string]interface{})["text"]; text != escaped {
+		t.Errorf("expected the field to be escaped as %q, got %q", escaped, text)
+	}
+
+	// Each < becomes four characters once escaped, so the section has to be cut after escaping.
+	raw := strings.Repeat("<", 5000)
+	notification = testNotification()
+	notification.Event.Raw = &raw
+	body = sendTo(t, destination.Slack, notification)
+	text := body["blocks"].([]interface{})[2].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+	if len([]rune(text)) > 3000 {
+		t.Errorf("expected the raw event to fit Slack's section limit of 3000, got %d characters", len([]rune(text)))
+	}
+	if !strings.HasSuffix(text, "&lt;…```") || strings.Contains(text, "<") {
+		t.Errorf("expected the raw event to be escaped and cut between entities, got %q", text[len(text)-20:])
+	}
+}
+
+func TestChatErrorsHideURL(t *testing.T) {
+	// Nothing listens on port 1, so the request fails with an error that would quote the URL.
+	chat := destination.Slack("ops", "http://127.0.0.1:1/services/T000/B000/s3cr3t", webhooktest.LoopbackClient())
+	ctx := helpers.WithRetryPolicy(context.Background(), helpers.RetryPolicy{WebhookAttempts: 1})
+	err := chat.Send(ctx, testNotification())
+	if err == nil {
+		t.Fatal("expected sending to fail")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") || !strings.Contains(err.Error(), "ops") {
+		t.Errorf("expected the error to name the destination instead of its URL, got %s", err)
+	}
+}
+
+func TestTeams(t *testing.T) {
+	body := sendTo(t, destination.Teams, testNotification())
+	if body["type"] != "message" {
+		t.Errorf("expected a message, got %v", body["type"])
+	}
+	attachments, _ := body["attachments"].([]interface{})
+	if len(attachments) != 1 {
+		t.Fatalf("expected one attachment, got %v", body["attachments"])
+	}
+	card := attachments[0].(map[string]interface{})
+	if card["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("expected an Adaptive Card, got %v", card["contentType"])
+	}
+	contains(t, card["content"], `"type":"AdaptiveCard"`, `"title":"Query","value":"q1"`, `"title":"errors","value":"7"`, "disk full on web-1")
+}
+
+func TestDiscord(t *testing.T) {
+	body := sendTo(t, destination.Discord, testNotification())
+	embeds, _ := body["embeds"].([]interface{})
+	if len(embeds) != 1 {
+		t.Fatalf("expected one embed, got %v", body["embeds"])
+	}
+	embed := embeds[0].(map[string]interface{})
+	if embed["title"] != "Condition errors>=5 matched" || embed["timestamp"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("expected the condition as title and the event time, got %v", embed)
+	}
+	contains(t, embed["fields"], `"name":"host","value":"web-1"`, `"name":"Event type","value":"alert"`)
+
+	notification := testNotification()
+	notification.Event.Derived = map[string]interface{}{strings.Repeat("n", 300): 1}
+	body = sendTo(t, destination.Discord, notification)
+	for _, field := range body["embeds"].([]interface{})[0].(map[string]interface{})["fields"].([]interface{}) {
+		if name := field.(map[string]interface{})["name"].(string); len([]rune(name)) > 256 {
+			t.Errorf("expected field names to be cut to Discord's limit of 256, got %d characters", len([]rune(name)))
+		}
+	}
+}
+
+func TestNewMessageLimitsFields(t *testing.T) {
+	notification := testNotification()
+	notification.Event.Derived = map[string]interface{}{}
+	for i := 0; i < 30; i++ {
+		notification.Event.Derived[fmt.Sprintf("field%02d", i)] = strings.Repeat("x", 500)
+	}
+
+	message := destination.NewMessage(notification)
+	if len(message.Fields) != 20 {
+		t.Fatalf("expected the fields to be capped at 20, got %d", len(message.Fields))
+	}
+	if last := message.Fields[19]; last.Value != "14 more fields" {
+		t.Errorf("expected the last field to count the ones left out, got %+v", last)
+	}
+	if value := message.Fields[3].Value; len([]rune(value)) != 200 || !strings.HasSuffix(value, "…") {
+		t.Errorf("expected long values to be truncated, got %d runes", len([]rune(value)))
+	}
+}
@@ -0,0 +1,233 @@
+// Package destination holds the named webhook targets from the config, which args refer to as @name, so URLs
+// and credentials are kept out of queries and event payloads.
+package destination
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"golang.org/x/time/rate"
+)
+
+// Prefix marks a webhook in args as the name of a destination rather than a URL.
+const Prefix = "@"
+
+// Notification is what a destination is sent when a webhook condition matches.
+type Notification struct {
+	QueryID string
+	Step    int
+	// Condition is the part of the args that matched, e.g. "errors>=5".
+	Condition string
+	Event     go_system_api.EventData
+	// Report, if set, is called with errors that happen after Send returned, such as a digest failing to send.
+	Report func(err error)
+}
+
+// Destination receives notifications for a name in the registry.
+type Destination interface {
+	Send(ctx context.Context, notification Notification) error
+}
+
+// Flusher is implemented by destinations that hold notifications back, such as email digests.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// RateLimit bounds how often a destination is sent to. A zero PerSecond means no limit.
+type RateLimit struct {
+	PerSecond float64
+	Burst     int
+}
+
+// Limited waits for the rate limit before each send, so bursts of matches are spread out rather than dropped.
+// Waiting gives up when ctx is done.
+func Limited(destination Destination, limit RateLimit) Destination {
+	if limit.PerSecond <= 0 {
+		return destination
+	}
+	return &limited{next: destination, limiter: rate.NewLimiter(rate.Limit(limit.PerSecond), max(limit.Burst, 1))}
+}
+
+type limited struct {
+	next    Destination
+	limiter *rate.Limiter
+}
+
+func (l *limited) Send(ctx context.Context, notification Notification) error {
+	if err := l.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for rate limit: %w", err)
+	}
+	return l.next.Send(ctx, notification)
+}
+
+func (l *limited) Flush(ctx context.Context) error {
+	if flusher, ok := l.next.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
+func (l *limited) Close() error {
+	if closer, ok := l.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Registry maps names to destinations. It is not changed after it is built; reloads build a new one.
+// Requests and queued events hold the registry they started with, so it is only closed once they are done.
+type Registry struct {
+	destinations map[string]Destination
+
+	lock  sync.Mutex
+	holds int
+	idle  chan struct{} // Closed when the last hold is released, if anyone is waiting for that.
+}
+
+func NewRegistry(destinations map[string]Destination) *Registry {
+	lowered := make(map[string]Destination, len(destinations))
+	for name, destination := range destinations {
+		lowered[strings.ToLower(name)] = destination
+	}
+	return &Registry{destinations: lowered}
+}
+
+// Lookup returns the destination for a reference like "@oncall". Names are not case sensitive,
+// as the config file's keys aren't.
+func (r *Registry) Lookup(reference string) (Destination, error) {
+	name, ok := strings.CutPrefix(reference, Prefix)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a destination reference", reference)
+	}
+	if r != nil {
+		if destination, ok := r.destinations[strings.ToLower(name)]; ok {
+			return destination, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown destination %q", name)
+}
+
+// Hold keeps the destinations open until release is called, for work that may still send to them.
+func (r *Registry) Hold() (release func()) {
+	if r == nil {
+		return func() {}
+	}
+	r.lock.Lock()
+	r.holds++
+	r.lock.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.holds--
+			if r.holds == 0 && r.idle != nil {
+				close(r.idle)
+				r.idle = nil
+			}
+		})
+	}
+}
+
+// Hold holds the registry on ctx, see Registry.Hold.
+func Hold(ctx context.Context) (release func()) {
+	return FromContext(ctx).Hold()
+}
+
+// wait blocks until nothing holds the registry, or ctx is done.
+func (r *Registry) wait(ctx context.Context) error {
+	r.lock.Lock()
+	if r.holds == 0 {
+		r.lock.Unlock()
+		return nil
+	}
+	if r.idle == nil {
+		r.idle = make(chan struct{})
+	}
+	idle := r.idle
+	r.lock.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("destinations still in use: %w", ctx.Err())
+	}
+}
+
+// Flush sends whatever the destinations are holding back, before shutting down or replacing the registry.
+func (r *Registry) Flush(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	for _, destination := range r.destinations {
+		if flusher, ok := destination.(Flusher); ok {
+			errs = append(errs, flusher.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close waits until nothing holds the registry, or ctx is done, then flushes the destinations and closes those
+// holding connections open, such as message brokers.
+func (r *Registry) Close(ctx context.Context) error {
+	return r.Retire(ctx, nil)
+}
+
+// Retire is Close for a registry replaced by next, leaving alone the destinations carried over to next.
+func (r *Registry) Retire(ctx context.Context, next *Registry) error {
+	if r == nil {
+		return nil
+	}
+	// Flush and close regardless once ctx is done, as nothing else will.
+	errs := []error{r.wait(ctx)}
+	for _, destination := range r.destinations {
+		if next.contains(destination) {
+			continue
+		}
+		if flusher, ok := destination.(Flusher); ok {
+			errs = append(errs, flusher.Flush(ctx))
+		}
+		if closer, ok := destination.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// contains reports whether destination is one of the registry's, by identity.
+func (r *Registry) contains(destination Destination) bool {
+	if r == nil {
+		return false
+	}
+	for _, candidate := range r.destinations {
+		if candidate == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// IsReference reports whether a webhook from args names a destination.
+func IsReference(webhook string) bool {
+	return strings.HasPrefix(webhook, Prefix)
+}
+
+type registryKey struct{}
+
+// WithRegistry returns a copy of ctx whose @name webhooks are resolved from registry.
+func WithRegistry(ctx context.Context, registry *Registry) context.Context {
+	return context.WithValue(ctx, registryKey{}, registry)
+}
+
+// FromContext returns the registry on ctx, or nil if there is none, which has no destinations.
+func FromContext(ctx context.Context) *Registry {
+	registry, _ := ctx.Value(registryKey{}).(*Registry)
+	return registry
+}
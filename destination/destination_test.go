@@ -0,0 +1,83 @@
+package destination_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/webhooktest"
+)
+
+func TestHTTPSendsWithCredentials(t *testing.T) {
+	target := webhooktest.NewRecorder(t)
+	registry := destination.NewRegistry(map[string]destination.Destination{
+		"OnCall": &destination.HTTP{
+			Name:        "oncall",
+			URL:         target.Endpoint("/page"),
+			Method:      http.MethodPost,
+			Header:      http.Header{"X-Team": []string{"ops"}},
+			BearerToken: "s3cr3t",
+			Client:      webhooktest.LoopbackClient(),
+		},
+	})
+
+	oncall, err := registry.Lookup("@oncall")
+	if err != nil {
+		t.Fatalf("expected @oncall to be found ignoring case, got %s", err)
+	}
+	err = oncall.Send(context.Background(), destination.Notification{QueryID: "q1", Step: 2, Condition: "errors>=5"})
+	if err != nil {
+		t.Fatalf("sending: %s", err)
+	}
+
+	request := target.Wait(t)
+	if request.Method != http.MethodPost || request.Header.Get("Authorization") != "Bearer s3cr3t" || request.Header.Get("X-Team") != "ops" {
+		t.Errorf("expected a POST with the configured headers and token, got %s %v", request.Method, request.Header)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(request.Body, &body); err != nil || body["query_id"] != "q1" || body["condition"] != "errors>=5" {
+		t.Errorf("expected the notification as the body, got %s (%v)", request.Body, err)
+	}
+
+	if _, err := registry.Lookup("@missing"); err == nil {
+		t.Error("expected an unknown destination to fail")
+	}
+	if _, err := (*destination.Registry)(nil).Lookup("@oncall"); err == nil {
+		t.Error("expected a missing registry to have no destinations")
+	}
+}
+
+type countingDestination struct {
+	sends int
+}
+
+func (c *countingDestination) Send(ctx context.Context, notification destination.Notification) error {
+	c.sends++
+	return nil
+}
+
+func TestLimited(t *testing.T) {
+	counting := &countingDestination{}
+	limited := destination.Limited(counting, destination.RateLimit{PerSecond: 1, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := limited.Send(context.Background(), destination.Notification{}); err != nil {
+			t.Fatalf("expected the burst to be sent straight away, got %s", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limited.Send(ctx, destination.Notification{}); err == nil {
+		t.Fatalf("expected a send past the burst to wait beyond the deadline, got %v", err)
+	}
+	if counting.sends != 2 {
+		t.Errorf("expected 2 sends, got %d", counting.sends)
+	}
+
+	if unlimited := destination.Limited(counting, destination.RateLimit{}); unlimited != destination.Destination(counting) {
+		t.Error("expected no limit to leave the destination as it is")
+	}
+}
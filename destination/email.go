@@ -0,0 +1,312 @@
+package destination
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+)
+
+// SMTP security modes.
+const (
+	// SMTPStartTLS upgrades the connection before authenticating, and fails if the server can't. The default.
+	SMTPStartTLS = "starttls"
+	// SMTPTLS connects with TLS straight away, usually on port 465.
+	SMTPTLS = "tls"
+	// SMTPPlain never encrypts, for relays on the local network only.
+	SMTPPlain = "none"
+)
+
+const (
+	DefaultEmailSubject = `{{if gt .Count 1}}{{.Count}} webhook conditions matched{{else}}Condition {{.Condition}} matched for query {{.QueryID}}{{end}}`
+	DefaultEmailBody    = `{{range .Digest}}{{.Message.Title}}
+{{range .Message.Fields}}
+{{.Name}}: {{.Value}}{{end}}
+{{if .Message.Raw}}
+{{.Message.Raw}}
+{{end}}
+{{end}}`
+)
+
+// EmailSettings configure an Email destination.
+type EmailSettings struct {
+	// Addr is the host:port of the SMTP server.
+	Addr     string
+	From     string
+	To       []string
+	Username string
+	Password string
+	// Security is SMTPStartTLS, SMTPTLS or SMTPPlain.
+	Security string
+	// TLSConfig defaults to verifying the server against the host in Addr.
+	TLSConfig *tls.Config
+	// Subject and Body are text/template templates executed with EmailData, defaulting to DefaultEmailSubject
+	// and DefaultEmailBody.
+	Subject string
+	Body    string
+	// DigestWindow, if set, collects the notifications that arrive within it into one email.
+	DigestWindow time.Duration
+	// DigestMax sends a digest early once it has this many notifications. Zero means no limit.
+	DigestMax int
+	// Timeout bounds sending a digest once its window ends. Zero means no limit.
+	Timeout time.Duration
+}
+
+// EmailData is what the subject and body templates are executed with. The fields of the first notification
+// are promoted, so templates for single notifications can use {{.QueryID}} and {{.Condition}} directly.
+type EmailData struct {
+	EmailItem
+	// Count is the number of notifications in the email, more than one for a digest.
+	Count  int
+	Digest []EmailItem
+}
+
+type EmailItem struct {
+	Notification
+	Message Message
+}
+
+// Email sends notifications by email, one at a time or as digests.
+type Email struct {
+	name     string
+	settings EmailSettings
+	subject  *template.Template
+	body     *template.Template
+	// The bare addresses of From and To, for the SMTP envelope.
+	envelopeFrom string
+	envelopeTo   []string
+
+	lock    sync.Mutex
+	pending []Notification
+	ctx     context.Context // Of the first pending notification, for logging and tracing the digest.
+	timer   *time.Timer
+	// generation counts the digests started, so a timer that fires after its digest was sent leaves the next one alone.
+	generation uint64
+}
+
+// ParseEmailTemplates checks the subject and body templates, empty ones being replaced with the defaults.
+func ParseEmailTemplates(subject string, body string) (*template.Template, *template.Template, error) {
+	if subject == "" {
+		subject = DefaultEmailSubject
+	}
+	if body == "" {
+		body = DefaultEmailBody
+	}
+	subjectTemplate, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("subject: %w", err)
+	}
+	bodyTemplate, err := template.New("body").Parse(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("body: %w", err)
+	}
+	return subjectTemplate, bodyTemplate, nil
+}
+
+func NewEmail(name string, settings EmailSettings) (*Email, error) {
+	subject, body, err := ParseEmailTemplates(settings.Subject, settings.Body)
+	if err != nil {
+		return nil, err
+	}
+	if settings.Security == "" {
+		settings.Security = SMTPStartTLS
+	}
+	email := &Email{name: name, settings: settings, subject: subject, body: body}
+	from, err := mail.ParseAddress(settings.From)
+	if err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+	email.envelopeFrom = from.Address
+	for _, to := range settings.To {
+		address, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("to: %w", err)
+		}
+		email.envelopeTo = append(email.envelopeTo, address.Address)
+	}
+	return email, nil
+}
+
+// Send emails the notification, or adds it to the digest being collected. Errors sending a digest are logged,
+// and passed to the Report of each notification in it.
+func (e *Email) Send(ctx context.Context, notification Notification) error {
+	if e.settings.DigestWindow <= 0 {
+		return e.send(ctx, []Notification{notification})
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.pending = append(e.pending, notification)
+	if len(e.pending) == 1 {
+		e.generation++
+		generation := e.generation
+		e.ctx = context.WithoutCancel(ctx)
+		e.timer = time.AfterFunc(e.settings.DigestWindow, func() { e.flushInBackground(generation) })
+	}
+	if e.settings.DigestMax > 0 && len(e.pending) >= e.settings.DigestMax {
+		go e.flushInBackground(e.generation)
+	}
+	return nil
+}
+
+// flushInBackground sends digest generation, unless it has already been sent.
+func (e *Email) flushInBackground(generation uint64) {
+	ctx := context.Background()
+	if e.settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.settings.Timeout)
+		defer cancel()
+	}
+	_ = e.flush(ctx, &generation)
+}
+
+// Flush sends the digest being collected straight away, giving up when ctx is done.
+func (e *Email) Flush(ctx context.Context) error {
+	return e.flush(ctx, nil)
+}
+
+// flush sends the digest being collected, or only digest generation if it is set. Stopping the timer doesn't
+// stop a callback that has already started, so the callback checks the generation instead.
+func (e *Email) flush(ctx context.Context, generation *uint64) error {
+	e.lock.Lock()
+	if generation != nil && *generation != e.generation {
+		e.lock.Unlock()
+		return nil
+	}
+	pending, digestCtx := e.pending, e.ctx
+	e.pending, e.ctx = nil, nil
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+	e.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// The digest is logged and traced as part of its first notification, but sent within ctx.
+	sendCtx, cancel := context.WithCancel(digestCtx)
+	defer cancel()
+	defer context.AfterFunc(ctx, cancel)()
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancelDeadline context.CancelFunc
+		sendCtx, cancelDeadline = context.WithDeadline(sendCtx, deadline)
+		defer cancelDeadline()
+	}
+
+	err := e.send(sendCtx, pending)
+	if err != nil {
+		logging.FromContext(digestCtx).Error("Error sending email digest", "destination", e.name, "notifications", len(pending), "error", err)
+		for _, notification := range pending {
+			if notification.Report != nil {
+				notification.Report(err)
+			}
+		}
+	}
+	return err
+}
+
+func (e *Email) send(ctx context.Context, notifications []Notification) error {
+	data := EmailData{Count: len(notifications)}
+	for _, notification := range notifications {
+		data.Digest = append(data.Digest, EmailItem{Notification: notification, Message: NewMessage(notification)})
+	}
+	data.EmailItem = data.Digest[0]
+
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, data); err != nil {
+		return fmt.Errorf("rendering subject: %w", err)
+	}
+	if err := e.body.Execute(&body, data); err != nil {
+		return fmt.Errorf("rendering body: %w", err)
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", e.settings.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(e.settings.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.TrimSpace(subject.String())))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: 8bit\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body.String(), "\r\n", "\n"), "\n", "\r\n"))
+
+	if err := e.deliver(ctx, message.Bytes()); err != nil {
+		return fmt.Errorf("sending email via %s: %w", e.settings.Addr, err)
+	}
+	logging.FromContext(ctx).Debug("Sent email", "destination", e.name, "notifications", len(notifications))
+	return nil
+}
+
+func (e *Email) deliver(ctx context.Context, message []byte) error {
+	host, _, err := net.SplitHostPort(e.settings.Addr)
+	if err != nil {
+		return err
+	}
+	tlsConfig := e.settings.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: host}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if e.settings.Security == SMTPTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", e.settings.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", e.settings.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// Closing the connection unblocks whatever the client is waiting for when ctx is cancelled.
+	defer context.AfterFunc(ctx, func() { _ = conn.Close() })()
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if e.settings.Security == SMTPStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if e.settings.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", e.settings.Username, e.settings.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(e.envelopeFrom); err != nil {
+		return err
+	}
+	for _, to := range e.envelopeTo {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
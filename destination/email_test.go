@@ -0,0 +1,329 @@
+package destination_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+)
+
+type fakeMail struct {
+	From string
+	To   []string
+	Data string
+	TLS  bool
+	Auth string
+}
+
+// fakeSMTP is just enough of an SMTP server for net/smtp: STARTTLS when it has a certificate, AUTH PLAIN, and mail.
+type fakeSMTP struct {
+	Addr      string
+	tlsConfig *tls.Config
+	listener  net.Listener
+	lock      sync.Mutex
+	mails     []fakeMail
+	received  chan fakeMail
+}
+
+// newFakeSMTP starts a server, offering STARTTLS if withTLS. The returned pool trusts its certificate.
+func newFakeSMTP(t *testing.T, withTLS bool) (*fakeSMTP, *x509.CertPool) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	server := &fakeSMTP{Addr: listener.Addr().String(), listener: listener, received: make(chan fakeMail, 10)}
+
+	// Borrow the certificate httptest uses, which is valid for 127.0.0.1.
+	https := httptest.NewTLSServer(nil)
+	https.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(https.Certificate())
+	if withTLS {
+		server.tlsConfig = https.TLS
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return server, pool
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	var mail fakeMail
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.TrimSpace(line)
+		verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+		switch {
+		case verb == "EHLO" || verb == "HELO":
+			if s.tlsConfig != nil && !mail.TLS {
+				reply("250-fake")
+				reply("250-STARTTLS")
+			} else {
+				reply("250-fake")
+			}
+			reply("250 AUTH PLAIN")
+		case verb == "STARTTLS":
+			reply("220 ready")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, reader, mail.TLS = tlsConn, bufio.NewReader(tlsConn), true
+		case verb == "AUTH":
+			decoded, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(command, "AUTH PLAIN "))
+			mail.Auth = string(decoded)
+			reply("235 authenticated")
+		case verb == "MAIL":
+			mail.From = strings.Trim(strings.TrimPrefix(command, "MAIL FROM:"), "<>")
+			reply("250 ok")
+		case verb == "RCPT":
+			mail.To = append(mail.To, strings.Trim(strings.TrimPrefix(command, "RCPT TO:"), "<>"))
+			reply("250 ok")
+		case verb == "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mail.Data = data.String()
+			s.lock.Lock()
+			s.mails = append(s.mails, mail)
+			s.lock.Unlock()
+			s.received <- mail
+			reply("250 queued")
+		case verb == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (s *fakeSMTP) wait(t *testing.T) fakeMail {
+	t.Helper()
+	select {
+	case mail := <-s.received:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an email")
+		return fakeMail{}
+	}
+}
+
+func (s *fakeSMTP) count() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.mails)
+}
+
+func TestEmailStartTLS(t *testing.T) {
+	server, pool := newFakeSMTP(t, true)
+	email, err := destination.NewEmail("stakeholders", destination.EmailSettings{
+		Addr:      server.Addr,
+		From:      "Alerts <alerts@example.com>",
+		To:        []string{"ops@example.com", "The Boss <boss@example.com>"},
+		Username:  "user",
+		Password:  "pass",
+		TLSConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+		Subject:   "[{{.QueryID}}] {{.Condition}}",
+	})
+	if err != nil {
+		t.Fatalf("building email destination: %s", err)
+	}
+
+	if err := email.Send(context.Background(), testNotification()); err != nil {
+		t.Fatalf("sending: %s", err)
+	}
+	mail := server.wait(t)
+	if !mail.TLS || mail.Auth != "\x00user\x00pass" {
+		t.Errorf("expected to authenticate after STARTTLS, got TLS %t and auth %q", mail.TLS, mail.Auth)
+	}
+	if mail.From != "alerts@example.com" || strings.Join(mail.To, ",") != "ops@example.com,boss@example.com" {
+		t.Errorf("expected the bare addresses of the sender and recipients, got %s and %v", mail.From, mail.To)
+	}
+	for _, expected := range []string{"From: Alerts <alerts@example.com>\r\n", "Subject: [q1] errors>=5\r\n", "host: web-1", "disk full on web-1"} {
+		if !strings.Contains(mail.Data, expected) {
+			t.Errorf("expected %q in the email, got:\n%s", expected, mail.Data)
+		}
+	}
+}
+
+func TestEmailRequiresStartTLS(t *testing.T) {
+	server, _ := newFakeSMTP(t, false)
+	email, err := destination.NewEmail("stakeholders", destination.EmailSettings{
+		Addr:     server.Addr,
+		From:     "alerts@example.com",
+		To:       []string{"ops@example.com"},
+		Username: "user",
+		Password: "pass",
+	})
+	if err != nil {
+		t.Fatalf("building email destination: %s", err)
+	}
+	if err := email.Send(context.Background(), testNotification()); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Fatalf("expected sending to fail without STARTTLS, got %v", err)
+	}
+	if server.count() != 0 {
+		t.Error("expected nothing to be sent without STARTTLS")
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	server, _ := newFakeSMTP(t, false)
+	email, err := destination.NewEmail("stakeholders", destination.EmailSettings{
+		Addr:         server.Addr,
+		From:         "alerts@example.com",
+		To:           []string{"ops@example.com"},
+		Security:     destination.SMTPPlain,
+		DigestWindow: time.Hour,
+		DigestMax:    3,
+	})
+	if err != nil {
+		t.Fatalf("building email destination: %s", err)
+	}
+
+	for _, query := range []string{"q1", "q2"} {
+		notification := testNotification()
+		notification.QueryID = query
+		if err := email.Send(context.Background(), notification); err != nil {
+			t.Fatalf("sending: %s", err)
+		}
+	}
+	if server.count() != 0 {
+		t.Fatal("expected notifications to be held back for the digest")
+	}
+	if err := email.Flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	mail := server.wait(t)
+	if !strings.Contains(mail.Data, "Subject: 2 webhook conditions matched") ||
+		!strings.Contains(mail.Data, "Query: q1") || !strings.Contains(mail.Data, "Query: q2") {
+		t.Errorf("expected one digest of both notifications, got:\n%s", mail.Data)
+	}
+
+	// Reaching the maximum sends the digest without waiting for the window.
+	for i := 0; i < 3; i++ {
+		_ = email.Send(context.Background(), testNotification())
+	}
+	if mail := server.wait(t); !strings.Contains(mail.Data, "Subject: 3 webhook conditions matched") {
+		t.Errorf("expected a digest of 3 notifications, got:\n%s", mail.Data)
+	}
+}
+
+func TestEmailDigestIgnoresStaleTimer(t *testing.T) {
+	server, _ := newFakeSMTP(t, false)
+	email, err := destination.NewEmail("stakeholders", destination.EmailSettings{
+		Addr:         server.Addr,
+		From:         "alerts@example.com",
+		To:           []string{"ops@example.com"},
+		Security:     destination.SMTPPlain,
+		DigestWindow: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("building email destination: %s", err)
+	}
+
+	_ = email.Send(context.Background(), testNotification())
+	if err := email.Flush(context.Background()); err != nil {
+		t.Fatalf("flushing: %s", err)
+	}
+	server.wait(t)
+	_ = email.Send(context.Background(), testNotification())
+
+	// The first digest's timer can't send the second digest before its window is over.
+	email.FireStaleTimer()
+	if count := server.count(); count != 1 {
+		t.Fatalf("expected the stale timer to leave the new digest alone, got %d emails", count)
+	}
+}
+
+func TestEmailDigestFailure(t *testing.T) {
+	// A server that accepts connections and never greets, so only the context ends the delivery.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	email, err := destination.NewEmail("stakeholders", destination.EmailSettings{
+		Addr:         listener.Addr().String(),
+		From:         "alerts@example.com",
+		To:           []string{"ops@example.com"},
+		Security:     destination.SMTPPlain,
+		DigestWindow: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("building email destination: %s", err)
+	}
+	reported := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		notification := testNotification()
+		notification.Report = func(err error) { reported <- err }
+		if err := email.Send(context.Background(), notification); err != nil {
+			t.Fatalf("sending: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := email.Flush(ctx); err == nil {
+		t.Fatal("expected the digest to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected flushing to give up with its context, took %s", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-reported:
+			if err == nil {
+				t.Error("expected the digest error to be reported")
+			}
+		default:
+			t.Fatalf("expected each notification in the digest to be reported, got %d", i)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package destination
+
+// FireStaleTimer runs the timer callback of the digest before the one being collected, as when it fires
+// just as that digest is sent by reaching DigestMax.
+func (e *Email) FireStaleTimer() {
+	e.lock.Lock()
+	generation := e.generation - 1
+	e.lock.Unlock()
+	e.flushInBackground(generation)
+}
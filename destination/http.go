@@ -0,0 +1,69 @@
+package destination
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// HTTP calls a URL like a webhook from args would be, with the headers and credentials that can't go in args.
+type HTTP struct {
+	// Name is logged in place of the URL.
+	Name string
+	URL  string
+	// Method defaults to GET. Other methods send the notification as a JSON body.
+	Method string
+	Header http.Header
+	// BearerToken, or Username and Password, set the Authorization header.
+	BearerToken string
+	Username    string
+	Password    string
+	// Client defaults to the webhook client on ctx.
+	Client *http.Client
+}
+
+type httpBody struct {
+	QueryID   string                  `json:"query_id"`
+	Step      int                     `json:"step"`
+	Condition string                  `json:"condition"`
+	Event     go_system_api.EventData `json:"event"`
+}
+
+func (h *HTTP) Send(ctx context.Context, notification Notification) error {
+	request := helpers.WebhookRequest{Name: h.Name, Method: h.Method, URL: h.URL, Header: h.Header.Clone()}
+	if request.Method == "" {
+		request.Method = http.MethodGet
+	}
+	if request.Header == nil {
+		request.Header = http.Header{}
+	}
+	if h.BearerToken != "" {
+		request.Header.Set("Authorization", "Bearer "+h.BearerToken)
+	} else if h.Username != "" || h.Password != "" {
+		request.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(h.Username+":"+h.Password)))
+	}
+
+	if request.Method != http.MethodGet {
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+		body, err := json.Marshal(httpBody{
+			QueryID:   notification.QueryID,
+			Step:      notification.Step,
+			Condition: notification.Condition,
+			Event:     notification.Event,
+		})
+		if err != nil {
+			return err
+		}
+		request.Body = body
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	if h.Client != nil {
+		ctx = helpers.WithWebhookClient(ctx, h.Client)
+	}
+	return helpers.SendWebhook(ctx, request)
+}
@@ -0,0 +1,55 @@
+package destination
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl/plain"
+)
+
+// KafkaSettings configure a Kafka publisher.
+type KafkaSettings struct {
+	Brokers []string
+	Topic   string
+	// TLSConfig, if set, connects to the brokers with TLS.
+	TLSConfig *tls.Config
+	// Username and Password, if set, authenticate with SASL/PLAIN.
+	Username string
+	Password string
+}
+
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaPublisher publishes to a topic, waiting for all in-sync replicas to acknowledge each message.
+// Messages are partitioned by their key, so the matches of a query stay in order.
+// Brokers are only connected to on the first publish.
+func NewKafkaPublisher(settings KafkaSettings) Publisher {
+	transport := &kafka.Transport{TLS: settings.TLSConfig}
+	if settings.Username != "" {
+		transport.SASL = plain.Mechanism{Username: settings.Username, Password: settings.Password}
+	}
+	return &kafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(settings.Brokers...),
+		Topic:        settings.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 10 * time.Millisecond,
+		Transport:    transport,
+	}}
+}
+
+func (p *kafkaPublisher) Publish(ctx context.Context, message BrokerMessage) error {
+	headers := make([]kafka.Header, 0, len(message.Headers))
+	for key, value := range message.Headers {
+		headers = append(headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return p.writer.WriteMessages(ctx, kafka.Message{Key: []byte(message.Key), Value: message.Body, Headers: headers})
+}
+
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
@@ -0,0 +1,192 @@
+package destination_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/segmentio/kafka-go/protocol/saslauthenticate"
+	"github.com/segmentio/kafka-go/protocol/saslhandshake"
+)
+
+type fakeRecord struct {
+	Topic   string
+	Key     string
+	Value   string
+	Headers map[string]string
+	Auth    string
+	TLS     bool
+}
+
+// fakeKafka is just enough of a Kafka broker for kafka-go's writer: version negotiation, SASL/PLAIN, metadata
+// for one partition led by itself, and produce. It speaks the wire protocol, using kafka-go's own codec.
+type fakeKafka struct {
+	Addr     string
+	topic    string
+	tls      *tls.Config
+	received chan fakeRecord
+}
+
+// newFakeKafka starts a broker for topic, with TLS if withTLS. The returned pool trusts its certificate.
+func newFakeKafka(t *testing.T, topic string, withTLS bool) (*fakeKafka, *x509.CertPool) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+	broker := &fakeKafka{Addr: listener.Addr().String(), topic: topic, received: make(chan fakeRecord, 10)}
+
+	https := httptest.NewTLSServer(nil)
+	https.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(https.Certificate())
+	if withTLS {
+		broker.tls = https.TLS
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return broker, pool
+}
+
+func (b *fakeKafka) serve(conn net.Conn) {
+	defer conn.Close()
+	secure := false
+	if b.tls != nil {
+		tlsConn := tls.Server(conn, b.tls)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		conn, secure = tlsConn, true
+	}
+	host, portText, _ := net.SplitHostPort(b.Addr)
+	port, _ := strconv.Atoi(portText)
+	auth := ""
+
+	for {
+		version, correlationID, _, request, err := protocol.ReadRequest(conn)
+		if err != nil {
+			return
+		}
+		var response protocol.Message
+		switch request := request.(type) {
+		case *apiversions.Request:
+			response = &apiversions.Response{ApiKeys: []apiversions.ApiKeyResponse{
+				{ApiKey: int16(protocol.Produce), MinVersion: 3, MaxVersion: 7},
+				{ApiKey: int16(protocol.Metadata), MinVersion: 1, MaxVersion: 8},
+				{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+				{ApiKey: int16(protocol.SaslHandshake), MinVersion: 1, MaxVersion: 1},
+				{ApiKey: int16(protocol.SaslAuthenticate), MinVersion: 0, MaxVersion: 1},
+			}}
+		case *saslhandshake.Request:
+			response = &saslhandshake.Response{Mechanisms: []string{"PLAIN"}}
+		case *saslauthenticate.Request:
+			auth = string(request.AuthBytes)
+			response = &saslauthenticate.Response{}
+		case *metadata.Request:
+			response = &metadata.Response{
+				Brokers:      []metadata.ResponseBroker{{NodeID: 1, Host: host, Port: int32(port)}},
+				ControllerID: 1,
+				Topics: []metadata.ResponseTopic{{
+					Name:       b.topic,
+					Partitions: []metadata.ResponsePartition{{LeaderID: 1, ReplicaNodes: []int32{1}, IsrNodes: []int32{1}}},
+				}},
+			}
+		case *produce.Request:
+			produced := &produce.Response{}
+			for _, topic := range request.Topics {
+				result := produce.ResponseTopic{Topic: topic.Topic}
+				for _, partition := range topic.Partitions {
+					for {
+						record, err := partition.RecordSet.Records.ReadRecord()
+						if err != nil {
+							if !errors.Is(err, io.EOF) {
+								return
+							}
+							break
+						}
+						key, _ := protocol.ReadAll(record.Key)
+						value, _ := protocol.ReadAll(record.Value)
+						headers := map[string]string{}
+						for _, header := range record.Headers {
+							headers[header.Key] = string(header.Value)
+						}
+						b.received <- fakeRecord{Topic: topic.Topic, Key: string(key), Value: string(value), Headers: headers, Auth: auth, TLS: secure}
+					}
+					result.Partitions = append(result.Partitions, produce.ResponsePartition{Partition: partition.Partition})
+				}
+				produced.Topics = append(produced.Topics, result)
+			}
+			response = produced
+		default:
+			return
+		}
+
+		var buffer bytes.Buffer
+		if err := protocol.WriteResponse(&buffer, version, correlationID, response); err != nil {
+			return
+		}
+		if _, err := conn.Write(buffer.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeKafka) wait(t *testing.T) fakeRecord {
+	t.Helper()
+	select {
+	case record := <-b.received:
+		return record
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a record")
+		return fakeRecord{}
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	broker, pool := newFakeKafka(t, "matches", true)
+	publisher := destination.NewKafkaPublisher(destination.KafkaSettings{
+		Brokers:   []string{broker.Addr},
+		Topic:     "matches",
+		TLSConfig: &tls.Config{RootCAs: pool},
+		Username:  "user",
+		Password:  "pass",
+	})
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := publisher.Publish(ctx, destination.BrokerMessage{Key: "q1", Body: []byte(`{"query_id":"q1"}`), Headers: map[string]string{"step": "2"}})
+	if err != nil {
+		t.Fatalf("publishing: %s", err)
+	}
+
+	record := broker.wait(t)
+	if !record.TLS || record.Auth != "\x00user\x00pass" {
+		t.Errorf("expected to authenticate with SASL/PLAIN over TLS, got TLS %t and auth %q", record.TLS, record.Auth)
+	}
+	if record.Topic != "matches" || record.Key != "q1" || record.Value != `{"query_id":"q1"}` || record.Headers["step"] != "2" {
+		t.Errorf("expected the message on the topic, keyed by query, got %+v", record)
+	}
+}
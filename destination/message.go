@@ -0,0 +1,75 @@
+package destination
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxFields keeps messages readable, and under the field limits of the chat tools.
+	maxFields = 20
+	maxValue  = 200
+	maxRaw    = 1000
+)
+
+// Message is a notification laid out for people to read, which the chat destinations turn into their own format.
+type Message struct {
+	Title  string
+	Fields []MessageField
+	// Raw is the start of the raw event, if it has one.
+	Raw  string
+	Time *time.Time
+}
+
+type MessageField struct {
+	Name  string
+	Value string
+}
+
+// NewMessage describes which condition matched, followed by the event's metadata and derived fields in name order.
+func NewMessage(notification Notification) Message {
+	event := notification.Event
+	message := Message{
+		Title: fmt.Sprintf("Condition %s matched", notification.Condition),
+		Fields: []MessageField{
+			{Name: "Query", Value: notification.QueryID},
+			{Name: "Step", Value: fmt.Sprint(notification.Step)},
+		},
+		Time: event.TimeStamp,
+	}
+	if event.EventType != nil {
+		message.Fields = append(message.Fields, MessageField{Name: "Event type", Value: *event.EventType})
+	}
+	if event.Category != nil {
+		message.Fields = append(message.Fields, MessageField{Name: "Category", Value: *event.Category})
+	}
+
+	names := make([]string, 0, len(event.Derived))
+	for name := range event.Derived {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if len(message.Fields) == maxFields-1 && i < len(names)-1 {
+			message.Fields = append(message.Fields, MessageField{Name: "…", Value: fmt.Sprintf("%d more fields", len(names)-i)})
+			break
+		}
+		message.Fields = append(message.Fields, MessageField{Name: name, Value: truncate(fmt.Sprint(event.Derived[name]), maxValue)})
+	}
+
+	if event.Raw != nil {
+		message.Raw = truncate(*event.Raw, maxRaw)
+	}
+	return message
+}
+
+// truncate shortens s to at most n runes, marking that it was cut.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,158 @@
+// Package egress decides which destinations outbound requests may reach, so URLs taken from events can't be used
+// to call internal services or cloud metadata endpoints.
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// ErrBlocked is wrapped by every error returned for a destination the policy doesn't allow.
+var ErrBlocked = errors.New("blocked by egress policy")
+
+var (
+	// privateRanges are only reachable from inside a network: RFC 1918, carrier-grade NAT, unique local
+	// IPv6, loopback, and the unspecified address, which connects to the local host.
+	privateRanges = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("fc00::/7"),
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("::/128"),
+	}
+	// linkLocalRanges include the metadata endpoints of most clouds, e.g. 169.254.169.254.
+	linkLocalRanges = []netip.Prefix{
+		netip.MustParsePrefix("169.254.0.0/16"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+	// alwaysBlocked can't be the address of a single web server.
+	alwaysBlocked = []netip.Prefix{
+		netip.MustParsePrefix("224.0.0.0/4"),
+		netip.MustParsePrefix("ff00::/8"),
+		netip.MustParsePrefix("255.255.255.255/32"),
+	}
+)
+
+// Policy lists the destinations that may be called. The zero Policy allows public http and https
+// addresses, and blocks private, loopback and link-local ones.
+type Policy struct {
+	// Schemes allowed, http and https if empty.
+	Schemes []string
+	// AllowHosts, if not empty, are the only hosts that may be called. A pattern is either a host name,
+	// or "*." followed by a domain to match its subdomains.
+	AllowHosts []string
+	// DenyHosts may never be called, even if they are in AllowHosts.
+	DenyHosts []string
+	// AllowCIDRs may be called even if they are private, link-local or in DenyCIDRs.
+	AllowCIDRs []netip.Prefix
+	DenyCIDRs  []netip.Prefix
+	// AllowPrivate lets private and loopback addresses be called.
+	AllowPrivate bool
+	// AllowLinkLocal lets link-local addresses, including cloud metadata endpoints, be called.
+	AllowLinkLocal bool
+}
+
+// CheckURL checks the scheme and host of u. Hosts given by name are checked again once resolved, see Transport.
+func (p *Policy) CheckURL(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !containsFold(schemes, scheme) {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrBlocked, u.Scheme)
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("%w: no host in %q", ErrBlocked, u.Redacted())
+	}
+	if matchesAny(p.DenyHosts, host) {
+		return fmt.Errorf("%w: host %q is denied", ErrBlocked, host)
+	}
+	if len(p.AllowHosts) > 0 && !matchesAny(p.AllowHosts, host) {
+		return fmt.Errorf("%w: host %q is not in the allowed hosts", ErrBlocked, host)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return p.CheckIP(ip)
+	}
+	return nil
+}
+
+// CheckIP checks an address a request is about to connect to.
+func (p *Policy) CheckIP(ip netip.Addr) error {
+	ip = ip.Unmap().WithZone("")
+	switch {
+	case containsIP(p.AllowCIDRs, ip):
+		return nil
+	case containsIP(p.DenyCIDRs, ip):
+		return fmt.Errorf("%w: address %s is denied", ErrBlocked, ip)
+	case containsIP(alwaysBlocked, ip):
+		return fmt.Errorf("%w: address %s is not unicast", ErrBlocked, ip)
+	case !p.AllowPrivate && containsIP(privateRanges, ip):
+		return fmt.Errorf("%w: address %s is private", ErrBlocked, ip)
+	case !p.AllowLinkLocal && containsIP(linkLocalRanges, ip):
+		return fmt.Errorf("%w: address %s is link-local", ErrBlocked, ip)
+	}
+	return nil
+}
+
+// ParseCIDRs parses a list of CIDRs. A bare address is taken as a single host.
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+		if domain, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
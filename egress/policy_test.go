@@ -0,0 +1,145 @@
+package egress
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckURL(t *testing.T) {
+	policy := &Policy{
+		AllowHosts: []string{"hooks.example.com", "*.example.org", "10.1.2.3", "169.254.169.254"},
+		DenyHosts:  []string{"admin.example.org"},
+		AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.1.2.0/24")},
+	}
+	tests := []struct {
+		url     string
+		allowed bool
+	}{
+		{"https://hooks.example.com/alert", true},
+		{"https://HOOKS.example.com./alert", true},
+		{"https://ci.example.org/build", true},
+		{"https://example.org/", false},
+		{"https://admin.example.org/", false},
+		{"https://other.example.com/", false},
+		{"ftp://hooks.example.com/", false},
+		{"file:///etc/passwd", false},
+		{"http://10.1.2.3:8080/", true},
+		{"http://169.254.169.254/latest/meta-data/", false},
+	}
+	for _, test := range tests {
+		parsed, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatalf("parsing %s: %s", test.url, err)
+		}
+		err = policy.CheckURL(parsed)
+		if test.allowed && err != nil {
+			t.Errorf("expected %s to be allowed, got %s", test.url, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrBlocked) {
+			t.Errorf("expected %s to be blocked, got %v", test.url, err)
+		}
+	}
+}
+
+func TestCheckIP(t *testing.T) {
+	tests := []struct {
+		policy  Policy
+		ip      string
+		allowed bool
+	}{
+		{Policy{}, "93.184.216.34", true},
+		{Policy{}, "2606:2800:220:1::1", true},
+		{Policy{}, "127.0.0.1", false},
+		{Policy{}, "::1", false},
+		{Policy{}, "0.0.0.0", false},
+		{Policy{}, "10.0.0.1", false},
+		{Policy{}, "::ffff:192.168.1.1", false},
+		{Policy{}, "fd00::1", false},
+		{Policy{}, "169.254.169.254", false},
+		{Policy{}, "fe80::1%eth0", false},
+		{Policy{}, "224.0.0.1", false},
+		{Policy{AllowPrivate: true}, "10.0.0.1", true},
+		{Policy{AllowPrivate: true}, "169.254.169.254", false},
+		{Policy{AllowPrivate: true, AllowLinkLocal: true}, "169.254.169.254", true},
+		{Policy{DenyCIDRs: []netip.Prefix{netip.MustParsePrefix("93.184.0.0/16")}}, "93.184.216.34", false},
+		{Policy{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}}, "10.0.0.1", true},
+	}
+	for _, test := range tests {
+		err := test.policy.CheckIP(netip.MustParseAddr(test.ip))
+		if test.allowed && err != nil {
+			t.Errorf("expected %s to be allowed by %+v, got %s", test.ip, test.policy, err)
+		}
+		if !test.allowed && !errors.Is(err, ErrBlocked) {
+			t.Errorf("expected %s to be blocked by %+v, got %v", test.ip, test.policy, err)
+		}
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	prefixes, err := ParseCIDRs([]string{"10.0.0.5/8", "192.168.1.1", "::1"})
+	if err != nil {
+		t.Fatalf("parsing: %s", err)
+	}
+	expected := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}
+	for i, prefix := range prefixes {
+		if prefix.String() != expected[i] {
+			t.Errorf("expected %s, got %s", expected[i], prefix)
+		}
+	}
+	if _, err := ParseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an invalid CIDR to fail")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	port := target.URL[strings.LastIndex(target.URL, ":"):]
+	redirect := httptest.NewServer(http.RedirectHandler("http://localhost"+port+"/", http.StatusFound))
+	defer redirect.Close()
+
+	get := func(policy *Policy, url string) error {
+		res, err := policy.Client(5 * time.Second).Get(url)
+		if err == nil {
+			_ = res.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(&Policy{}, target.URL); !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected loopback to be blocked by default, got %v", err)
+	}
+	// The name passes the URL check, the address it resolves to is blocked when connecting.
+	if err := get(&Policy{}, "http://localhost"+port+"/"); !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected a name resolving to loopback to be blocked, got %v", err)
+	}
+	if err := get(&Policy{AllowPrivate: true}, target.URL); err != nil {
+		t.Errorf("expected loopback to be allowed with AllowPrivate, got %s", err)
+	}
+	if err := get(&Policy{AllowPrivate: true, DenyHosts: []string{"localhost"}}, redirect.URL); !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected a redirect to a denied host to be blocked, got %v", err)
+	}
+}
+
+func TestTransportVerifiesCertificates(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	// The policy's transport is its own, so skipping verification on the default transport doesn't carry over.
+	defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	defer func() { http.DefaultTransport.(*http.Transport).TLSClientConfig = defaultTLS }()
+
+	res, err := (&Policy{AllowPrivate: true}).Client(5 * time.Second).Get(target.URL)
+	if err == nil {
+		_ = res.Body.Close()
+		t.Fatal("expected a certificate that isn't trusted to be rejected")
+	}
+}
@@ -0,0 +1,60 @@
+package egress
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// Transport returns a transport that only makes requests the policy allows. The URL of every request, including
+// each redirect, is checked before it is sent, and the address a host name resolved to is checked before
+// connecting, so a name can't be pointed at a blocked address after the URL was checked.
+//
+// Requests are not sent through HTTP_PROXY, as the proxy would resolve and connect on our behalf.
+func (p *Policy) Transport() http.RoundTripper {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: unexpected address %q", ErrBlocked, address)
+			}
+			return p.CheckIP(addrPort.Addr())
+		},
+	}
+	// A transport of our own, rather than a clone of http.DefaultTransport, so changes made to the default one
+	// elsewhere in the process don't carry over.
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &policyTransport{policy: p, next: transport}
+}
+
+type policyTransport struct {
+	policy *Policy
+	next   http.RoundTripper
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.CheckURL(req.URL); err != nil {
+		if req.Body != nil {
+			_ = req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// Client returns a client with timeout that only makes requests the policy allows.
+func (p *Policy) Client(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: p.Transport()}
+}
@@ -0,0 +1,50 @@
+package helpers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/egress"
+)
+
+type webhookClientKey struct{}
+type forwardClientKey struct{}
+
+// Timeouts of the default clients, the same as the config defaults.
+const (
+	DefaultWebhookTimeout = 10 * time.Second
+	DefaultForwardTimeout = 30 * time.Second
+)
+
+// The clients used when ctx has none, with the same egress rules as the config defaults. Webhook URLs can be
+// anywhere, so private, loopback and link-local addresses are blocked. Forward and error URLs are the steps of the
+// pipeline, which usually share a private network, so only link-local addresses are blocked for them.
+var (
+	defaultWebhookClient = (&egress.Policy{}).Client(DefaultWebhookTimeout)
+	defaultForwardClient = (&egress.Policy{AllowPrivate: true}).Client(DefaultForwardTimeout)
+)
+
+// WithWebhookClient returns a copy of ctx whose webhook calls are made with client.
+func WithWebhookClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, webhookClientKey{}, client)
+}
+
+// WithForwardClient returns a copy of ctx whose forwards and error reports are made with client.
+func WithForwardClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, forwardClientKey{}, client)
+}
+
+func webhookClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(webhookClientKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return defaultWebhookClient
+}
+
+func forwardClient(ctx context.Context) *http.Client {
+	if client, ok := ctx.Value(forwardClientKey{}).(*http.Client); ok && client != nil {
+		return client
+	}
+	return defaultForwardClient
+}
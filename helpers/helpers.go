@@ -2,22 +2,44 @@ package helpers
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os"
 
 	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/egress"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	// jsoniter is used for increased performance.
 	// The standard library would also work, if dependencies are not permitted.
 	jsoniter "github.com/json-iterator/go"
 
-	"crypto/tls"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 )
 
-func LogError(err string, event *go_system_api.ProcessingEvent) {
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// postJSON sends body to url, propagating the trace context in ctx.
+func postJSON(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	tracing.Inject(ctx, req.Header)
+	return forwardClient(ctx).Do(req)
+}
+
+func LogError(ctx context.Context, err string, event *go_system_api.ProcessingEvent) {
+	ctx, span := tracing.Tracer().Start(ctx, "LogError", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+	logger.Warn("Reporting error for event", "error", err)
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	var err_url = event.Commands.ErrorUrl
 	if err_url != "" {
@@ -31,56 +53,252 @@ func LogError(err string, event *go_system_api.ProcessingEvent) {
 		}
 		jsonData, err := json.Marshal(errorBody)
 		if err != nil {
-			_, _ = os.Stderr.WriteString(fmt.Sprintf("Error marshalling error body: %s \n", err))
+			logger.Error("Error marshalling error body", "error", err)
 			return
 		}
-		for i := 1; i < 4; i++ {
-			r, err := http.Post(err_url, "application/json", bytes.NewBuffer(jsonData))
-			if err == nil && r.StatusCode == 200 {
+		policy := retryPolicy(ctx)
+		for i := 1; i <= policy.ForwardAttempts && policy.backoff(ctx, i); i++ {
+			r, err := postJSON(ctx, err_url, jsonData)
+			if err == nil {
+				_ = r.Body.Close()
+				if r.StatusCode == 200 {
+					return
+				}
+				logger.Error("Error logging error", "error_url", err_url, "status", r.StatusCode, "attempt", i)
+			} else if errors.Is(err, egress.ErrBlocked) {
+				logger.Error("Error URL blocked", "error_url", err_url, "error", err)
 				return
 			} else {
-				_, _ = os.Stderr.WriteString(fmt.Sprintf("Error logging error: %s \n", err))
+				logger.Error("Error logging error", "error_url", err_url, "error", err, "attempt", i)
 			}
 		}
 	} else {
-		_, _ = os.Stderr.WriteString("Error URL was nil for event. Won't be able to log errors.")
+		logger.Warn("Error URL was nil for event. Won't be able to log errors.")
 	}
 }
 
-func ForwardEvent(event *go_system_api.ProcessingEvent) {
+func ForwardEvent(ctx context.Context, event *go_system_api.ProcessingEvent) {
+	ctx, span := tracing.Tracer().Start(ctx, "ForwardEvent", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	logger := logging.FromContext(ctx)
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	if !HasNextStep(event) {
+		logger.Debug("Final step, nothing to forward to")
+		return
+	}
 	event.Commands.Step += 1
+	span.SetAttributes(attribute.String("query.id", event.Commands.QueryId), attribute.Int("query.step", event.Commands.Step))
 
 	jsonData, err := json.Marshal(event)
 	if err != nil {
-		_, _ = os.Stderr.WriteString(fmt.Sprintf("Error marshalling event: %s \n", err))
-		LogError(fmt.Sprintf("Failed to serialise event: %s", err), event)
+		logger.Error("Error marshalling event", "error", err)
+		LogError(ctx, fmt.Sprintf("Failed to serialise event: %s", err), event)
 		return
 	}
 
-	for i := 1; i < 4; i++ {
-		r, err := http.Post(event.Commands.Commands[event.Commands.Step].Url, "application/json", bytes.NewBuffer(jsonData))
-		if err == nil && r.StatusCode == 200 {
-			return
+	policy := retryPolicy(ctx)
+	for i := 1; i <= policy.ForwardAttempts && policy.backoff(ctx, i); i++ {
+		if i > 1 {
+			metrics.ForwardRetries.Inc()
+		}
+		next_url := event.Commands.Commands[event.Commands.Step].Url
+		span.SetAttributes(attribute.Int("forward.attempts", i))
+		r, err := postJSON(ctx, next_url, jsonData)
+		if err == nil {
+			_ = r.Body.Close()
+			if r.StatusCode == 200 {
+				metrics.ForwardAttempts.WithLabelValues("success").Inc()
+				logger.Debug("Forwarded event", "url", next_url)
+				return
+			}
+			metrics.ForwardAttempts.WithLabelValues("error").Inc()
+			logger.Warn("Error forwarding event", "url", next_url, "status", r.StatusCode, "attempt", i)
+		} else if errors.Is(err, egress.ErrBlocked) {
+			metrics.ForwardAttempts.WithLabelValues("blocked").Inc()
+			logger.Warn("Forward blocked", "url", next_url, "error", err)
+			break
 		} else {
-			_, _ = os.Stderr.WriteString(fmt.Sprintf("Error forwarding event: %s \n", err))
+			metrics.ForwardAttempts.WithLabelValues("error").Inc()
+			logger.Warn("Error forwarding event", "url", next_url, "error", err, "attempt", i)
 		}
 	}
+	metrics.ForwardFailures.Inc()
+	tracing.RecordError(span, fmt.Errorf("failed to forward event"))
+	logger.Error("Giving up forwarding event")
+
+}
+
+// ErrBatchUnsupported is returned by ForwardBatch when the batch endpoint doesn't take batches.
+var ErrBatchUnsupported = errors.New("next step does not support batches")
+
+// batchResponse holds the per-item results of a /query/batch response.
+type batchResponse struct {
+	Results []struct {
+		Index  int    `json:"index"`
+		Status string `json:"status"`
+	} `json:"results"`
+}
+
+// ForwardBatch forwards events that share a next step in a single request to batch_url, that step's batch endpoint.
+// Items the next step reports as rejected for lack of capacity are retried, alone, on the following attempts.
+// It returns the indexes of the events that weren't accepted, and why. The events are not modified, so the
+// caller can fall back to ForwardEvent for them on ErrBatchUnsupported.
+func ForwardBatch(ctx context.Context, batch_url string, events []*go_system_api.ProcessingEvent) ([]int, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "ForwardBatch", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("forward.url", batch_url), attribute.Int("forward.batch_size", len(events))))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	remaining := make([]int, len(events))
+	for i := range events {
+		remaining[i] = i
+	}
+	var rejected []int
+	policy := retryPolicy(ctx)
+	for i := 1; i <= policy.ForwardAttempts && policy.backoff(ctx, i); i++ {
+		if i > 1 {
+			metrics.ForwardRetries.Inc()
+		}
+		batch := make([]go_system_api.ProcessingEvent, 0, len(remaining))
+		for _, index := range remaining {
+			next := *events[index]
+			next.Commands.Step += 1
+			batch = append(batch, next)
+		}
+		jsonData, err := json.Marshal(batch)
+		if err != nil {
+			tracing.RecordError(span, err)
+			return append(rejected, remaining...), err
+		}
+
+		r, err := postJSON(ctx, batch_url, jsonData)
+		if errors.Is(err, egress.ErrBlocked) {
+			metrics.ForwardAttempts.WithLabelValues("blocked").Inc()
+			tracing.RecordError(span, err)
+			return append(rejected, remaining...), err
+		}
+		if err != nil {
+			metrics.ForwardAttempts.WithLabelValues("error").Inc()
+			logger.Warn("Error forwarding batch", "url", batch_url, "error", err, "attempt", i)
+			continue
+		}
+		var response batchResponse
+		decodeErr := json.NewDecoder(r.Body).Decode(&response)
+		_ = r.Body.Close()
+		switch r.StatusCode {
+		case http.StatusOK, http.StatusAccepted:
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+			return append(rejected, remaining...), ErrBatchUnsupported
+		default:
+			metrics.ForwardAttempts.WithLabelValues("error").Inc()
+			logger.Warn("Error forwarding batch", "url", batch_url, "status", r.StatusCode, "attempt", i)
+			continue
+		}
+		if decodeErr != nil {
+			// Without per-item results, there is no telling which items were taken, so none are resent.
+			logger.Warn("Batch response has no per-item results", "url", batch_url, "error", decodeErr)
+		}
 
+		// Items that were invalid will be again, only those turned away for lack of capacity are worth retrying.
+		var retry []int
+		for _, result := range response.Results {
+			if result.Index < 0 || result.Index >= len(remaining) {
+				continue
+			}
+			switch result.Status {
+			case "processed", "queued":
+			case "queue_full":
+				retry = append(retry, remaining[result.Index])
+			default:
+				rejected = append(rejected, remaining[result.Index])
+			}
+		}
+		metrics.ForwardAttempts.WithLabelValues("success").Inc()
+		logger.Debug("Forwarded batch", "url", batch_url, "size", len(remaining), "retry", len(retry))
+		remaining = retry
+		if len(remaining) == 0 {
+			break
+		}
+	}
+	if failed := append(rejected, remaining...); len(failed) > 0 {
+		err := fmt.Errorf("%d of %d events were not accepted by %s", len(failed), len(events), batch_url)
+		tracing.RecordError(span, err)
+		return failed, err
+	}
+	return nil, nil
 }
 
-func ParseProcessingEvent(w http.ResponseWriter, r *http.Request) (go_system_api.ProcessingEvent, error) {
+func ParseProcessingEvent(r *http.Request) (go_system_api.ProcessingEvent, error) {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	var query go_system_api.ProcessingEvent
 	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
-		_, _ = os.Stderr.WriteString(fmt.Sprintf("Error decoding query: %s \n", err))
-		InternalServerErrorHandler(w, r)
-		//TODO! Forward event
-		return go_system_api.ProcessingEvent{}, nil
+		return go_system_api.ProcessingEvent{}, fmt.Errorf("invalid JSON body: %w", err)
 	}
 	return query, nil
 }
 
+// ValidateProcessingEvent checks the fields needed to evaluate the current step and forward to the next one.
+func ValidateProcessingEvent(event *go_system_api.ProcessingEvent) error {
+	if event.Commands.QueryId == "" {
+		return fmt.Errorf("query_id is required")
+	}
+	if len(event.Commands.Commands) == 0 {
+		return fmt.Errorf("commands must not be empty")
+	}
+	if event.Commands.Step < 0 || event.Commands.Step >= len(event.Commands.Commands) {
+		return fmt.Errorf("step %d is out of range for %d commands", event.Commands.Step, len(event.Commands.Commands))
+	}
+	return nil
+}
+
+// HasNextStep reports whether there is a command after the current step to forward the event to.
+// An event on the final step is the end of its pipeline.
+func HasNextStep(event *go_system_api.ProcessingEvent) bool {
+	return event.Commands.Step+1 < len(event.Commands.Commands)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func BadRequestHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: err.Error()})
+}
+
+func TooManyRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusTooManyRequests)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: "queue is full, retry later"})
+}
+
+func RequestEntityTooLargeHandler(w http.ResponseWriter, r *http.Request) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: "request body too large"})
+}
+
+func UnauthorizedHandler(w http.ResponseWriter, r *http.Request) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: "missing or invalid credentials"})
+}
+
+func ForbiddenHandler(w http.ResponseWriter, r *http.Request) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: "caller is not allowed"})
+}
+
 func InternalServerErrorHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusInternalServerError)
 	_, _ = w.Write([]byte("Internal Server Error"))
@@ -159,13 +377,90 @@ func GetIntValue(event *go_system_api.EventData, field string) (int, error) {
 
 }
 
-func SendGetWebhook(webhook string) (err error) {
+func SendGetWebhook(ctx context.Context, webhook string) (err error) {
+	return SendWebhook(ctx, WebhookRequest{Method: http.MethodGet, URL: webhook})
+}
+
+// WebhookRequest is a webhook call with more than a GET to a URL.
+type WebhookRequest struct {
+	// Name is logged instead of the URL when set, for URLs that carry secrets.
+	Name   string
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+// SendWebhook makes the request with the webhook client on ctx, retrying until it gets a 2xx response.
+// Client errors other than 408 and 429 won't go away by retrying, so they fail straight away.
+func SendWebhook(ctx context.Context, webhook WebhookRequest) (err error) {
+	shown := tracing.URL(webhook.URL)
+	destination := metrics.Destination(webhook.Name)
+	if webhook.Name != "" {
+		shown = webhook.Name
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "SendWebhook",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("webhook.url", shown)))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+	logger := logging.FromContext(ctx).With("webhook", shown)
 	var res *http.Response
-	for i := 0; i < 4; i++ {
-		res, err = http.Get(webhook)
-		if err == nil && res.StatusCode == 200 {
+	policy := retryPolicy(ctx)
+	for i := 0; i < policy.WebhookAttempts && policy.backoff(ctx, i+1); i++ {
+		var req *http.Request
+		req, err = http.NewRequestWithContext(ctx, webhook.Method, webhook.URL, bytes.NewReader(webhook.Body))
+		if err != nil {
+			if webhook.Name != "" {
+				err = fmt.Errorf("invalid URL for %s", webhook.Name)
+			}
+			return
+		}
+		for key, values := range webhook.Header {
+			req.Header[key] = values
+		}
+		tracing.Inject(ctx, req.Header)
+		start := time.Now()
+		res, err = webhookClient(ctx).Do(req)
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			// Client errors quote the URL, which would put its secret or query string in the logs and error reports.
+			urlErr.URL = shown
+		}
+		metrics.WebhookDuration.WithLabelValues(destination).Observe(time.Since(start).Seconds())
+		if errors.Is(err, egress.ErrBlocked) {
+			metrics.WebhookSends.WithLabelValues(destination, "blocked").Inc()
+			logger.Warn("Webhook blocked", "error", err)
+			return
+		}
+		if err != nil {
+			metrics.WebhookSends.WithLabelValues(destination, "error").Inc()
+			logger.Warn("Error calling webhook", "error", err, "attempt", i+1)
+			continue
+		}
+		_ = res.Body.Close()
+		metrics.WebhookSends.WithLabelValues(destination, strconv.Itoa(res.StatusCode)).Inc()
+		span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+		if res.StatusCode >= 200 && res.StatusCode < 300 {
+			logger.Debug("Called webhook", "status", res.StatusCode)
 			return
 		}
+		err = fmt.Errorf("webhook returned status %d", res.StatusCode)
+		logger.Warn("Webhook returned unexpected status", "status", res.StatusCode, "attempt", i+1)
+		if !retryableStatus(res.StatusCode) {
+			return
+		}
+	}
+	if err == nil {
+		// Cancelled before the first attempt was made.
+		err = ctx.Err()
 	}
 	return
 }
+
+// retryableStatus reports whether a webhook may accept the request if it is sent again.
+func retryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
@@ -0,0 +1,43 @@
+package helpers
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func FuzzParseProcessingEvent(f *testing.F) {
+	f.Add(`{"commands":{"query_id":"q","commands":[{"args":"a>=1 http://x"},{"url":"http://y"}],"step":0},"event":{"derived":{"a":1}}}`)
+	f.Add(`{"commands":{"query_id":"q","commands":[],"step":5}}`)
+	f.Add(`{"commands":{"step":-1}}`)
+	f.Add(`{not json`)
+	f.Add(`[]`)
+
+	f.Fuzz(func(t *testing.T, body string) {
+		r, err := http.NewRequest(http.MethodPost, "/query", strings.NewReader(body))
+		if err != nil {
+			t.Skip()
+		}
+		event, err := ParseProcessingEvent(r)
+		if err != nil {
+			return
+		}
+		if err := ValidateProcessingEvent(&event); err != nil {
+			return
+		}
+
+		// A valid event must be safe to evaluate and forward without going out of bounds.
+		_ = event.Commands.Commands[event.Commands.Step].Args
+		if HasNextStep(&event) {
+			_ = event.Commands.Commands[event.Commands.Step+1].Url
+		}
+		for field := range event.Event.Derived {
+			_, _ = GetIntValue(&event.Event, field)
+			_, _ = GetStringValue(&event.Event, field)
+		}
+		for _, field := range []string{"raw", "event_type", "category"} {
+			_, _ = GetIntValue(&event.Event, field)
+			_, _ = GetStringValue(&event.Event, field)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package helpers
+
+import (
+	"context"
+	"time"
+)
+
+// RetryPolicy controls how often outbound requests are retried.
+type RetryPolicy struct {
+	// WebhookAttempts is the total number of tries for a webhook call, including the first.
+	WebhookAttempts int
+	// ForwardAttempts is the total number of tries for a forward or error report, including the first.
+	ForwardAttempts int
+	// Backoff is the wait before the first retry, doubling for each retry after that.
+	Backoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	WebhookAttempts: 4,
+	ForwardAttempts: 3,
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy returns a copy of ctx whose outbound requests are retried according to policy.
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, policy)
+}
+
+func retryPolicy(ctx context.Context) RetryPolicy {
+	policy, ok := ctx.Value(retryPolicyKey{}).(RetryPolicy)
+	if !ok {
+		return DefaultRetryPolicy
+	}
+	if policy.WebhookAttempts < 1 {
+		policy.WebhookAttempts = 1
+	}
+	if policy.ForwardAttempts < 1 {
+		policy.ForwardAttempts = 1
+	}
+	return policy
+}
+
+// backoff waits before retry number attempt, where attempt 2 is the first retry.
+// Returns false if ctx is done before the wait is over.
+func (p RetryPolicy) backoff(ctx context.Context, attempt int) bool {
+	if p.Backoff <= 0 || attempt < 2 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(p.Backoff << min(attempt-2, 16))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -4,288 +4,286 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	go_system_api "github.com/DeltaScratchpad/go-system-api"
-	"github.com/DeltaScratchpad/webhook-interface/server"
-	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
-	"log"
 	"net/http"
-	"os"
 	"strings"
 	"testing"
-	"time"
-)
 
-const ListenServerPort = "9099"
-
-var addr = "localhost"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/server"
+	"github.com/DeltaScratchpad/webhook-interface/webhooktest"
+)
 
-func simpleWebhookListener(c chan<- bool, port string) {
-	// This function creates a simple webserver which listens for an incoming web request.
-	// When a request is received, the function sends a message to the channel.
+func TestHandlerServer(t *testing.T) {
+	t.Log("Testing for a successful comparison.")
 
-	// Make a shutdown channel
-	shutdown := make(chan bool)
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	target := webhooktest.NewRecorder(t)
+	next := webhooktest.NewEventSink(t)
 
-	// Create a simple server
-	mux := http.NewServeMux()
-	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
-		c <- true
-		shutdown <- true
-	})
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", target.Endpoint("/webhook")).
+		Next(next.Endpoint("/query")).
+		ErrorURL("Error Url").
+		Build()
 
-	srv := &http.Server{
-		Addr:    addr + ":" + port,
-		Handler: mux,
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
-
-	// Wait for the shutdown signal
-	<-shutdown
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server Shutdown Failed:%+v", err)
+	if request := target.Wait(t); request.Path != "/webhook" {
+		t.Fatalf("Expected the webhook to be called on /webhook, got %s", request.Path)
+	}
+	if forwarded := next.WaitEvent(t); forwarded.Commands.Step != 1 {
+		t.Fatalf("Expected the event to be forwarded at step 1, got %d", forwarded.Commands.Step)
 	}
 }
 
-func TestHandlerServer(t *testing.T) {
-	var server_port = "9099"
-	var target_listener = "9100"
-	var dump_listener = "9101"
+func TestShouldNotSendWebhook(t *testing.T) {
+	t.Log("Testing for a negative comparison.")
 
-	t.Log("Testing for a successful comparison.")
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	target := webhooktest.NewRecorder(t)
+	next := webhooktest.NewEventSink(t)
 
-	// This function tests the WebhookQueryHandler, by creating an instance of it, then sending an example request
-	// to the SimpleWebHook Listener function. The WebhookQueryHandler should receive the request and process it.
-
-	// Create a channel to receive the message from the SimpleWebhookListener
-	c := make(chan bool, 1)
-	done := make(chan os.Signal, 1)
-	dump := make(chan bool, 1)
-
-	go server.CreateServer(&addr, server_port, done, webhook_tracker.NewLocalWebhookState())
-	go simpleWebhookListener(c, target_listener)
-	go simpleWebhookListener(dump, dump_listener)
-
-	// Wait for 2 seconds to allow the servers to start
-	time.Sleep(2 * time.Second)
-
-	// Make test data
-	raw := "Test"
-	timeVal := time.Now()
-	derived := make(map[string]interface{})
-	derived["fieldname"] = 30
-	var testEventData = go_system_api.EventData{
-		Raw:       &raw,
-		IndexTime: &timeVal,
-		TimeStamp: &timeVal,
-		EventType: &raw,
-		Category:  &raw,
-		Derived:   derived,
-	}
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 29).
+		Webhook("fieldname>=30", target.Endpoint("/webhook")).
+		Next(next.Endpoint("/query")).
+		ErrorURL("Error Url").
+		Build()
 
-	var testCommandList = go_system_api.CommandList{
-		QueryId: "Test Command 1",
-		Commands: []go_system_api.CommandStep{
-			{CommandName: "Command 1", Args: "fieldname>=30 http://localhost:" + target_listener + "/webhook", Url: "http://localhost:" + server_port + "/query"},
-			{CommandName: "Command 2", Args: "args 2", Url: "http://localhost:" + "9101" + "/webhook"},
-		},
-		Step:     0,
-		ErrorUrl: "Error Url",
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
 	}
 
-	var testProcessingEvent = go_system_api.ProcessingEvent{
-		Commands: testCommandList,
-		Event:    testEventData,
+	// The event is only forwarded once the condition has been evaluated, so by then the webhook would have been called.
+	next.WaitEvent(t)
+	if count := target.Count(); count != 0 {
+		t.Fatalf("Expected the webhook not to be called, got %d calls", count)
 	}
+}
 
-	log.Println("Sending test event")
-	// Send the request
-	err := sendEvent(&testProcessingEvent, "http://localhost:"+server_port+"/query")
-	if err != nil {
-		log.Fatalf("Error sending test event: %s", err)
-	}
+func TestStringComparison(t *testing.T) {
+	t.Log("Testing for a successful string comparison.")
 
-	log.Println("Waiting for webhook to be received")
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	target := webhooktest.NewRecorder(t)
+	next := webhooktest.NewEventSink(t)
 
-	// Wait for the message from the SimpleWebhookListener
-	select {
-	case <-c:
-		log.Println("Test Passed")
-		return
-	case <-time.After(5 * time.Second):
-		log.Fatalf("Test Failed")
-		t.FailNow()
+	// This test sends a processing event with a string field rather than an integer field.
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", "orange").
+		Webhook("fieldname=orange", target.Endpoint("/webhook")).
+		Next(next.Endpoint("/query")).
+		ErrorURL("Error Url").
+		Build()
+
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
 	}
-}
 
-func TestShouldNotSendWebhook(t *testing.T) {
-	var server_port = "9102"
-	var target_listener = "9103"
-	var dump_listener = "9104"
+	target.Wait(t)
+}
 
-	t.Log("Testing for a negative comparison.")
+func TestMalformedInputIsRejected(t *testing.T) {
+	t.Log("Testing that malformed events are rejected and reported.")
 
-	// This function tests the WebhookQueryHandler, by creating an instance of it, then sending an example request
-	// to the SimpleWebHook Listener function. The WebhookQueryHandler should not receive the request and process it.
-
-	// Create a channel to receive the message from the SimpleWebhookListener
-	c := make(chan bool, 1)
-	done := make(chan os.Signal, 1)
-	dump := make(chan bool, 1)
-
-	go server.CreateServer(&addr, server_port, done, webhook_tracker.NewLocalWebhookState())
-	go simpleWebhookListener(c, target_listener)
-	go simpleWebhookListener(dump, dump_listener)
-
-	// Wait for 2 seconds to allow the servers to start
-	time.Sleep(2 * time.Second)
-
-	// Make test data
-	raw := "Test"
-	timeVal := time.Now()
-	derived := make(map[string]interface{})
-	derived["fieldname"] = 29
-	var testEventData = go_system_api.EventData{
-		Raw:       &raw,
-		IndexTime: &timeVal,
-		TimeStamp: &timeVal,
-		EventType: &raw,
-		Category:  &raw,
-		Derived:   derived,
-	}
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	errorSink := webhooktest.NewErrorSink(t)
+	other := webhooktest.NewRecorder(t)
 
-	var testCommandList = go_system_api.CommandList{
-		QueryId: "Test Command 1",
-		Commands: []go_system_api.CommandStep{
-			{CommandName: "Command 1", Args: "fieldname>=30 http://localhost:" + target_listener + "/webhook", Url: "http://localhost:" + server_port + "/query"},
-			{CommandName: "Command 2", Args: "args 2", Url: "http://localhost:" + dump_listener + "/webhook"},
-		},
-		Step:     0,
-		ErrorUrl: "Error Url",
+	if status := srv.Post(t, "/query", []byte("{not json")); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for malformed JSON, got %d", status)
 	}
 
-	var testProcessingEvent = go_system_api.ProcessingEvent{
-		Commands: testCommandList,
-		Event:    testEventData,
+	// The step points past the end of the commands, so the event can't be processed or forwarded.
+	event := webhooktest.NewEvent("Test Command 1").
+		Webhook("fieldname>=30", other.Endpoint("/other")).
+		Step(3).
+		ErrorURL(errorSink.Endpoint("/webhook")).
+		Build()
+	jsonData, err := json.Marshal(&event)
+	if err != nil {
+		t.Fatalf("Error marshalling event: %s", err)
 	}
-
-	log.Println("Sending test event")
-	// Send the request
-	err := sendEvent(&testProcessingEvent, "http://localhost:"+server_port+"/query")
+	r, err := srv.Client().Post(srv.QueryURL(), "application/json", strings.NewReader(string(jsonData)))
 	if err != nil {
-		log.Fatalf("Error sending test event: %s", err)
+		t.Fatalf("Error sending invalid event: %s", err)
 	}
-
-	log.Println("Waiting for webhook to be received")
-
-	// If channel C receives a message, the test fails, if it doesn't, the test passes
-	select {
-	case <-c:
-		log.Fatalf("Test Failed")
-		t.Fail()
-	case <-time.After(5 * time.Second):
-		log.Println("Test Passed")
-		return
+	var body map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	_ = r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest || body["error"] == "" {
+		t.Fatalf("Expected 400 with an error message for an invalid event, got %d %v", r.StatusCode, body)
 	}
 
+	if report := errorSink.WaitError(t); report.QueryID != "Test Command 1" {
+		t.Fatalf("Expected the error report to be for the invalid event, got %+v", report)
+	}
+	if count := other.Count(); count != 0 {
+		t.Fatalf("Expected the invalid event not to call its webhook, got %d calls", count)
+	}
 }
 
-func TestStringComparison(t *testing.T) {
-	var server_port = "9105"
-	var target_listener = "9106"
-	var dump_listener = "9107"
+func TestFinalStepIsNotForwarded(t *testing.T) {
+	t.Log("Testing that an event on the last step of its pipeline is processed without being forwarded.")
 
-	t.Log("Testing for a successful string comparison.")
+	errorSink := webhooktest.NewErrorSink(t)
+	// Cleanups run in reverse, so this checks for error reports once the server has drained.
+	t.Cleanup(func() {
+		if reports := errorSink.Errors(t); len(reports) != 0 {
+			t.Errorf("Expected no error reports for the final step, got %+v", reports)
+		}
+	})
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	target := webhooktest.NewRecorder(t)
 
-	// This test sends a processing event with a string field rather than an integer field.
-	// This function tests the WebhookQueryHandler, by creating an instance of it, then sending an example request
-	// to the SimpleWebHook Listener function. The WebhookQueryHandler should receive the request and process it.
-
-	// Create a channel to receive the message from the SimpleWebhookListener
-	c := make(chan bool, 1)
-	done := make(chan os.Signal, 1)
-	dump := make(chan bool, 1)
-
-	go server.CreateServer(&addr, server_port, done, webhook_tracker.NewLocalWebhookState())
-	go simpleWebhookListener(c, target_listener)
-	go simpleWebhookListener(dump, dump_listener)
-
-	// Wait for 2 seconds to allow the servers to start
-	time.Sleep(2 * time.Second)
-
-	// Make test data
-	raw := "Test"
-	timeVal := time.Now()
-	derived := make(map[string]interface{})
-	derived["fieldname"] = "orange"
-	var testEventData = go_system_api.EventData{
-		Raw:       &raw,
-		IndexTime: &timeVal,
-		TimeStamp: &timeVal,
-		EventType: &raw,
-		Category:  &raw,
-		Derived:   derived,
-	}
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", target.Endpoint("/webhook")).
+		ErrorURL(errorSink.Endpoint("/error")).
+		Build()
 
-	var testCommandList = go_system_api.CommandList{
-		QueryId: "Test Command 1",
-		Commands: []go_system_api.CommandStep{
-			{CommandName: "Command 1", Args: "fieldname=orange http://localhost:" + target_listener + "/webhook", Url: "http://localhost:" + server_port + "/query"},
-			{CommandName: "Command 2", Args: "args 2", Url: "http://localhost:" + dump_listener + "/webhook"},
-		},
-		Step:     0,
-		ErrorUrl: "Error Url",
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200 for an event on its final step, got %d", status)
 	}
+	target.Wait(t)
+}
 
-	var testProcessingEvent = go_system_api.ProcessingEvent{
-		Commands: testCommandList,
-		Event:    testEventData,
-	}
+func TestNamedDestination(t *testing.T) {
+	t.Log("Testing that @name webhooks are sent to the configured destination.")
 
-	log.Println("Sending test event")
-	// Send the request
-	err := sendEvent(&testProcessingEvent, "http://localhost:"+server_port+"/query")
-	if err != nil {
-		log.Fatalf("Error sending test event: %s", err)
+	target := webhooktest.NewRecorder(t)
+	registry := destination.NewRegistry(map[string]destination.Destination{
+		"oncall": &destination.HTTP{Name: "oncall", URL: target.Endpoint("/page"), BearerToken: "s3cr3t"},
+	})
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback(), server.WithDestinations(registry))
+	next := webhooktest.NewEventSink(t)
+	errorSink := webhooktest.NewErrorSink(t)
+
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", "@oncall").
+		Next(next.Endpoint("/query")).
+		ErrorURL(errorSink.Endpoint("/error")).
+		Build()
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if request := target.Wait(t); request.Path != "/page" || request.Header.Get("Authorization") != "Bearer s3cr3t" {
+		t.Fatalf("Expected the destination to be called with its token, got %s %v", request.Path, request.Header)
 	}
 
-	log.Println("Waiting for webhook to be received")
+	event = webhooktest.NewEvent("Test Command 2").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", "@missing").
+		Next(next.Endpoint("/query")).
+		ErrorURL(errorSink.Endpoint("/error")).
+		Build()
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if report := errorSink.WaitError(t); !strings.Contains(report.ErrorMsg, "unknown destination") {
+		t.Fatalf("Expected an unknown destination to be reported, got %+v", report)
+	}
+}
 
-	// Wait for the message from the SimpleWebhookListener
-	select {
-	case <-c:
-		log.Println("Test Passed")
-		return
-	case <-time.After(5 * time.Second):
-		log.Fatalf("Test Failed")
-		t.FailNow()
+func TestDefaultClientsBlockLoopback(t *testing.T) {
+	t.Log("Testing that webhooks to loopback addresses are blocked unless allowed, while the pipeline may use them.")
+
+	srv := webhooktest.NewServer(t)
+	target := webhooktest.NewRecorder(t)
+	next := webhooktest.NewEventSink(t)
+	errorSink := webhooktest.NewErrorSink(t)
+
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", target.Endpoint("/webhook")).
+		Next(next.Endpoint("/query")).
+		ErrorURL(errorSink.Endpoint("/error")).
+		Build()
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
 	}
 
+	if report := errorSink.WaitError(t); !strings.Contains(report.ErrorMsg, "blocked by egress policy") {
+		t.Fatalf("Expected the blocked webhook to be reported, got %+v", report)
+	}
+	if forwarded := next.WaitEvent(t); forwarded.Commands.Step != 1 {
+		t.Fatalf("Expected the event to be forwarded to the next step on a loopback address, got step %d", forwarded.Commands.Step)
+	}
+	if count := target.Count(); count != 0 {
+		t.Fatalf("Expected the webhook on a loopback address to be blocked, got %d calls", count)
+	}
 }
 
-func sendEvent(event *go_system_api.ProcessingEvent, url string) error {
-	// Send a Post request to the url
-	jsonData, err := json.Marshal(event)
-	if err != nil {
-		log.Printf("Error marshalling event: %s \n", err)
-		return err
+func TestFailingWebhookIsReported(t *testing.T) {
+	t.Log("Testing that a webhook that keeps returning errors is reported to the error URL.")
+
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback())
+	target := webhooktest.NewRecorder(t)
+	target.Respond("/down", http.StatusInternalServerError)
+	target.Respond("/missing", http.StatusNotFound)
+	next := webhooktest.NewEventSink(t)
+	errorSink := webhooktest.NewErrorSink(t)
+
+	for i, path := range []string{"/down", "/missing"} {
+		event := webhooktest.NewEvent("Test Command "+path).
+			Field("fieldname", 30).
+			Webhook("fieldname>=30", target.Endpoint(path)).
+			Next(next.Endpoint("/query")).
+			ErrorURL(errorSink.Endpoint("/error")).
+			Build()
+		if status := srv.Send(t, event); status != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", status)
+		}
+		errorSink.WaitFor(t, i+1)
+		if report := errorSink.Errors(t)[i]; report.QueryID != "Test Command "+path || !strings.Contains(report.ErrorMsg, "status") {
+			t.Fatalf("Expected the failing webhook to be reported, got %+v", report)
+		}
 	}
 
-	for i := 1; i < 4; i++ {
-		log.Printf("Sending event to: %s \n", url)
-		r, err := http.Post(url, "application/json", strings.NewReader(string(jsonData)))
-		if err == nil && r.StatusCode == 200 {
-			return nil
+	var down, missing int
+	for _, request := range target.Requests() {
+		if request.Path == "/down" {
+			down++
 		} else {
-			log.Printf("Error forwarding event: %s \n", err)
+			missing++
 		}
 	}
-	return err
+	if down != helpers.DefaultRetryPolicy.WebhookAttempts || missing != 1 {
+		t.Errorf("Expected a 500 to be retried and a 404 not to be, got %d and %d calls", down, missing)
+	}
+}
+
+// laterFailure accepts notifications and then fails them, as an email digest does when it can't be sent.
+type laterFailure struct{}
+
+func (laterFailure) Send(ctx context.Context, notification destination.Notification) error {
+	go notification.Report(errors.New("digest could not be sent"))
+	return nil
+}
+
+func TestLaterDestinationFailureIsReported(t *testing.T) {
+	t.Log("Testing that failures reported after a destination accepted a notification reach the error URL.")
+
+	registry := destination.NewRegistry(map[string]destination.Destination{"digest": laterFailure{}})
+	srv := webhooktest.NewServer(t, webhooktest.AllowLoopback(), server.WithDestinations(registry))
+	next := webhooktest.NewEventSink(t)
+	errorSink := webhooktest.NewErrorSink(t)
+
+	event := webhooktest.NewEvent("Test Command 1").
+		Field("fieldname", 30).
+		Webhook("fieldname>=30", "@digest").
+		Next(next.Endpoint("/query")).
+		ErrorURL(errorSink.Endpoint("/error")).
+		Build()
+	if status := srv.Send(t, event); status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", status)
+	}
+	if report := errorSink.WaitError(t); report.QueryID != "Test Command 1" || !strings.Contains(report.ErrorMsg, "digest could not be sent") {
+		t.Fatalf("Expected the digest failure to be reported, got %+v", report)
+	}
 }
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "webhook_interface"
+
+// Condition evaluation results
+const (
+	Matched      = "matched"
+	NotMatched   = "not_matched"
+	MissingField = "missing_field"
+	InvalidArgs  = "invalid_args"
+)
+
+var (
+	QueryRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "query_requests_total",
+		Help:      "Requests received on /query and /query/batch, by endpoint and response code.",
+	}, []string{"endpoint", "code"})
+
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Time taken to handle a request on /query or /query/batch, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	ConditionEvaluations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "condition_evaluations_total",
+		Help:      "Webhook conditions evaluated, by result.",
+	}, []string{"result"})
+
+	WebhookSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_sends_total",
+		Help:      "Webhook send attempts, by destination and HTTP status, error if no response was received, blocked by the egress policy, or published to a message broker.",
+	}, []string{"destination", "status"})
+
+	WebhookDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "webhook_duration_seconds",
+		Help:      "Time taken by each webhook send attempt, by destination.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"destination"})
+
+	ForwardAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forward_attempts_total",
+		Help:      "Attempts to forward events to the next step, by result.",
+	}, []string{"result"})
+
+	ForwardRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forward_retries_total",
+		Help:      "Forwarding attempts that were retries of a failed attempt.",
+	})
+
+	ForwardFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "forward_failures_total",
+		Help:      "Events that could not be forwarded after all retries.",
+	})
+
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingest_queue_depth",
+		Help:      "Events accepted in async ingest mode that are waiting for a worker.",
+	})
+
+	QueueRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingest_queue_rejected_total",
+		Help:      "Events rejected with 429 because the async ingest queue was full.",
+	})
+
+	BatchItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "batch_items_total",
+		Help:      "Events received on /query/batch, by per-item result.",
+	}, []string{"result"})
+
+	StateDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_operation_duration_seconds",
+		Help:      "Latency of webhook state backend operations, by operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+
+	StateErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "state_operation_errors_total",
+		Help:      "Webhook state backend operations that returned an error, by operation.",
+	}, []string{"operation"})
+)
+
+// AdHocDestination is the destination label shared by webhooks called by URL rather than by name.
+const AdHocDestination = "url"
+
+// Destination is the destination label for a webhook, @name for configured destinations. URLs come from events,
+// so they all share AdHocDestination, or any caller could add a time series per host.
+func Destination(name string) string {
+	if name == "" {
+		return AdHocDestination
+	}
+	return "@" + name
+}
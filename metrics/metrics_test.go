@@ -0,0 +1,64 @@
+package metrics_test
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrape reads the value of series from /metrics, 0 if it hasn't been recorded yet.
+func scrape(t *testing.T, series string) float64 {
+	t.Helper()
+	res := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("parsing %s: %s", series, err)
+			}
+			return parsed
+		}
+	}
+	return 0
+}
+
+func TestWebhookSendsAreCountedByDestination(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	ctx := helpers.WithWebhookClient(context.Background(), target.Client())
+
+	adHoc := `webhook_interface_webhook_sends_total{destination="url",status="200"}`
+	named := `webhook_interface_webhook_sends_total{destination="@oncall",status="200"}`
+	durations := `webhook_interface_webhook_duration_seconds_count{destination="url"}`
+	before := []float64{scrape(t, adHoc), scrape(t, named), scrape(t, durations)}
+
+	// Ad-hoc URLs on different hosts and ports share one series.
+	for _, webhook := range []helpers.WebhookRequest{
+		{Method: http.MethodGet, URL: target.URL + "/a?token=1"},
+		{Method: http.MethodGet, URL: strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/b"},
+		{Name: "oncall", Method: http.MethodPost, URL: target.URL + "/oncall"},
+	} {
+		if err := helpers.SendWebhook(ctx, webhook); err != nil {
+			t.Fatalf("sending webhook: %s", err)
+		}
+	}
+
+	if got := scrape(t, adHoc) - before[0]; got != 2 {
+		t.Errorf("expected 2 ad-hoc sends, got %v", got)
+	}
+	if got := scrape(t, named) - before[1]; got != 1 {
+		t.Errorf("expected 1 send to @oncall, got %v", got)
+	}
+	if got := scrape(t, durations) - before[2]; got != 2 {
+		t.Errorf("expected 2 ad-hoc send durations, got %v", got)
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+// instrumentedState records the latency of every call to the wrapped backend.
+type instrumentedState struct {
+	state webhook_tracker.WebhookState
+}
+
+func InstrumentState(state webhook_tracker.WebhookState) webhook_tracker.WebhookState {
+	return &instrumentedState{state: state}
+}
+
+func observe(operation string, start time.Time) {
+	StateDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func (i *instrumentedState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
+	defer observe("increment_call_count", time.Now())
+	return i.state.IncrementCallCount(ctx, webhook, queryID)
+}
+
+func (i *instrumentedState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
+	defer observe("has_been_called", time.Now())
+	return i.state.HasBeenCalled(ctx, webhook, queryID)
+}
+
+func (i *instrumentedState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	defer observe("purge_expired", time.Now())
+	purged, err := i.state.PurgeExpired(ctx, ttl)
+	if err != nil {
+		StateErrors.WithLabelValues("purge_expired").Inc()
+	}
+	return purged, err
+}
+
+func (i *instrumentedState) Ping(ctx context.Context) error {
+	defer observe("ping", time.Now())
+	err := i.state.Ping(ctx)
+	if err != nil {
+		StateErrors.WithLabelValues("ping").Inc()
+	}
+	return err
+}
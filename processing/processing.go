@@ -1,22 +1,41 @@
 package processing
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"regexp"
 	"strconv"
 
 	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
 	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
 	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func ProcessProcessingEvent(query *go_system_api.ProcessingEvent, state webhook_tracker.WebhookState) {
+func ProcessProcessingEvent(ctx context.Context, query *go_system_api.ProcessingEvent, state webhook_tracker.WebhookState) {
+	ctx, span := tracing.Tracer().Start(ctx, "ProcessProcessingEvent", trace.WithAttributes(
+		attribute.String("query.id", query.Commands.QueryId),
+		attribute.Int("query.step", query.Commands.Step),
+	))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+
+	if query.Commands.Step < 0 || query.Commands.Step >= len(query.Commands.Commands) {
+		metrics.ConditionEvaluations.WithLabelValues(metrics.InvalidArgs).Inc()
+		helpers.LogError(ctx, fmt.Sprintf("Step %d is out of range for %d commands", query.Commands.Step, len(query.Commands.Commands)), query)
+		return
+	}
 
 	//Parse args
 	field, relation, threshold_int, threshold_str, webhook, err, isInt := parseArgs(&query.Commands.Commands[query.Commands.Step].Args)
 	if err != nil {
-		helpers.LogError(fmt.Sprintf("Failed to parse args: %s", err), query)
+		metrics.ConditionEvaluations.WithLabelValues(metrics.InvalidArgs).Inc()
+		helpers.LogError(ctx, fmt.Sprintf("Failed to parse args: %s", err), query)
 		return
 	}
 
@@ -25,34 +44,70 @@ func ProcessProcessingEvent(query *go_system_api.ProcessingEvent, state webhook_
 	value, err := helpers.GetIntValue(&query.Event, field)
 	if err == nil && isInt {
 		result = compareIntByRelation(value, threshold_int, relation)
-		//log.Printf("Result: %t, Value: %d\n", result, value)
+		logger.Debug("Compared field", "field", field, "relation", relation, "value", value, "threshold", threshold_int, "result", result)
 	} else {
 		value, err := helpers.GetStringValue(&query.Event, field)
 		if err == nil {
 			if relation == "=" {
 				result = value == threshold_str
-				//log.Printf("Result: %t, Value: %s\n", result, value)
+				logger.Debug("Compared field", "field", field, "relation", relation, "value", value, "threshold", threshold_str, "result", result)
 			}
 		} else {
 			// We didn't find the field, so we can't compare it.
+			logger.Debug("Field not found on event", "field", field)
+			metrics.ConditionEvaluations.WithLabelValues(metrics.MissingField).Inc()
 			return
 		}
 	}
 
+	span.SetAttributes(attribute.Bool("condition.matched", result))
+	if result {
+		metrics.ConditionEvaluations.WithLabelValues(metrics.Matched).Inc()
+	} else {
+		metrics.ConditionEvaluations.WithLabelValues(metrics.NotMatched).Inc()
+	}
+
 	// Check if we should call it, but only if it hasn't already been called.
 	// Under a race condition, multiple could be sent.
 	//TODO: Would need distributed locking to resolve.
-	if result && !state.HasBeenCalled(webhook, query.Commands.QueryId) {
-		os.Stderr.WriteString(fmt.Sprintf("Webhook broker: Calling webhook: %s\n", webhook))
-		err := helpers.SendGetWebhook(webhook)
+	if result && !state.HasBeenCalled(ctx, webhook, query.Commands.QueryId) {
+		logger.Info("Calling webhook", "webhook", webhook)
+		// Digests fail after the send returned, so a copy of the event is kept to report that.
+		failed := *query
+		report := func(ctx context.Context, err error) {
+			state.IncrementCallCount(ctx, webhook, failed.Commands.QueryId)
+			helpers.LogError(ctx, fmt.Sprintf("Failed to send webhook: %s", err), &failed)
+		}
+		err := sendWebhook(ctx, webhook, query, field+relation+threshold_str, report)
 		if err != nil {
-			state.IncrementCallCount(webhook, query.Commands.QueryId)
-			helpers.LogError(fmt.Sprintf("Failed to send webhook: %s", err), query)
+			report(ctx, err)
 			return
 		}
 	}
 }
 
+// sendWebhook calls a URL from args, or the destination it names as @name.
+// Destinations that send later call report with their errors.
+func sendWebhook(ctx context.Context, webhook string, query *go_system_api.ProcessingEvent, condition string, report func(context.Context, error)) error {
+	if !destination.IsReference(webhook) {
+		return helpers.SendGetWebhook(ctx, webhook)
+	}
+	target, err := destination.FromContext(ctx).Lookup(webhook)
+	if err != nil {
+		return err
+	}
+	return target.Send(ctx, destination.Notification{
+		QueryID:   query.Commands.QueryId,
+		Step:      query.Commands.Step,
+		Condition: condition,
+		Event:     query.Event,
+		Report: func(err error) {
+			// The request or queue entry the event came from is long done by then.
+			report(context.WithoutCancel(ctx), err)
+		},
+	})
+}
+
 var args_parser = regexp.MustCompile(`(?P<field>\w+)(?P<relation>[><=]{1,2})(?P<threshold>[\d\w]+)\s(?P<webhook>.+)`)
 var filed_index = args_parser.SubexpIndex(`field`)
 var relation_index = args_parser.SubexpIndex(`relation`)
@@ -60,7 +115,15 @@ var threshold_index = args_parser.SubexpIndex(`threshold`)
 var webhook_index = args_parser.SubexpIndex(`webhook`)
 
 func parseArgs(args *string) (field string, relation string, threshold_int int, threshold_str string, webhook string, err error, isInt bool) {
+	if args == nil {
+		err = fmt.Errorf("invalid args")
+		return
+	}
 	matches := args_parser.FindStringSubmatch(*args)
+	if matches == nil {
+		err = fmt.Errorf("invalid args")
+		return
+	}
 	var int_err error
 
 	field = matches[filed_index]
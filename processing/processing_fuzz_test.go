@@ -0,0 +1,21 @@
+package processing
+
+import "testing"
+
+func FuzzParseArgs(f *testing.F) {
+	f.Add("fieldname>=30 http://localhost:9100/webhook")
+	f.Add("fieldname=orange http://localhost:9100/webhook")
+	f.Add("args 2")
+	f.Add("")
+	f.Add("a<b c")
+
+	f.Fuzz(func(t *testing.T, args string) {
+		field, relation, _, threshold_str, webhook, err, _ := parseArgs(&args)
+		if err != nil {
+			return
+		}
+		if field == "" || relation == "" || threshold_str == "" || webhook == "" {
+			t.Fatalf("parseArgs(%q) returned no error but an empty part: %q %q %q %q", args, field, relation, threshold_str, webhook)
+		}
+	})
+}
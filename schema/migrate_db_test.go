@@ -0,0 +1,118 @@
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+)
+
+// testDatabases are the environment variables naming a scratch database for each dialect. Their tables are dropped.
+var testDatabases = map[string]string{
+	MySQL:    "TEST_MYSQL_DSN",
+	Postgres: "TEST_POSTGRES_URL",
+}
+
+// handWrittenSchemas are the schema files applied by hand before there were migrations.
+var handWrittenSchemas = map[string]string{
+	MySQL: `CREATE TABLE IF NOT EXISTS webhook_stats
+(
+    webhook      VARCHAR(96)    NOT NULL,
+    query_id     VARCHAR(96)    NOT NULL,
+    invoke_count INTEGER NOT NULL,
+    updated_at   TIMESTAMP      NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (webhook, query_id),
+    KEY webhook_stats_updated_at (updated_at)
+);`,
+	Postgres: `CREATE TABLE IF NOT EXISTS webhook_stats
+(
+    webhook      VARCHAR(96)    NOT NULL,
+    query_id     VARCHAR(96)    NOT NULL,
+    invoke_count INTEGER NOT NULL,
+    updated_at   TIMESTAMPTZ    NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (webhook, query_id)
+);
+
+CREATE INDEX IF NOT EXISTS webhook_stats_updated_at ON webhook_stats (updated_at);`,
+}
+
+func openTestDB(t *testing.T, dialect string) *sql.DB {
+	t.Helper()
+	dsn := os.Getenv(testDatabases[dialect])
+	if dsn == "" {
+		t.Skipf("%s is not set", testDatabases[dialect])
+	}
+	db, err := sql.Open(dialect, dsn)
+	if err != nil {
+		t.Fatalf("opening database: %s", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, table := range []string{"webhook_stats", "schema_migrations"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatalf("dropping %s: %s", table, err)
+		}
+	}
+	return db
+}
+
+func TestUpAdoptsHandWrittenSchema(t *testing.T) {
+	for _, dialect := range []string{MySQL, Postgres} {
+		t.Run(dialect, func(t *testing.T) {
+			ctx := context.Background()
+			db := openTestDB(t, dialect)
+			for _, statement := range splitStatements(handWrittenSchemas[dialect]) {
+				if _, err := db.Exec(statement); err != nil {
+					t.Fatalf("creating the hand-written schema: %s", err)
+				}
+			}
+
+			migrator, err := NewMigrator(db, dialect)
+			if err != nil {
+				t.Fatalf("building migrator: %s", err)
+			}
+			applied, err := migrator.Up(ctx)
+			if err != nil {
+				t.Fatalf("expected the existing schema to be adopted, got %s", err)
+			}
+			if len(applied) != 0 {
+				t.Errorf("expected no migrations to run against a schema that already has their changes, got %d", len(applied))
+			}
+			statuses, err := migrator.Status(ctx)
+			if err != nil {
+				t.Fatalf("reading status: %s", err)
+			}
+			for _, status := range statuses {
+				if !status.Applied {
+					t.Errorf("expected %04d_%s to be recorded as applied", status.Version, status.Name)
+				}
+			}
+
+			// The recorded migrations can be rolled back and applied again like any others.
+			if _, err := migrator.Down(ctx); err != nil {
+				t.Fatalf("rolling back: %s", err)
+			}
+			if applied, err := migrator.Up(ctx); err != nil || len(applied) != 1 {
+				t.Fatalf("expected the rolled back migration to be applied again, got %d and %v", len(applied), err)
+			}
+		})
+	}
+}
+
+func TestUpMigratesEmptyDatabase(t *testing.T) {
+	for _, dialect := range []string{MySQL, Postgres} {
+		t.Run(dialect, func(t *testing.T) {
+			db := openTestDB(t, dialect)
+			migrator, err := NewMigrator(db, dialect)
+			if err != nil {
+				t.Fatalf("building migrator: %s", err)
+			}
+			applied, err := migrator.Up(context.Background())
+			if err != nil || len(applied) != len(migrator.migrations) {
+				t.Fatalf("expected every migration to be applied, got %d and %v", len(applied), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package schema
+
+import "testing"
+
+func TestEmbeddedMigrationsAreComplete(t *testing.T) {
+	for _, dialect := range []string{MySQL, Postgres} {
+		migrations, err := loadMigrations(dialect)
+		if err != nil {
+			t.Fatalf("%s: %s", dialect, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("%s: no migrations embedded", dialect)
+		}
+		for i, migration := range migrations {
+			if migration.Version != i+1 {
+				t.Errorf("%s: expected version %d, got %d", dialect, i+1, migration.Version)
+			}
+			if migration.Down == "" {
+				t.Errorf("%s: migration %d_%s has no down script", dialect, migration.Version, migration.Name)
+			}
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements("CREATE TABLE a (id INT);\n\nCREATE INDEX b ON a (id);\n")
+	if len(statements) != 2 {
+		t.Fatalf("expected 2 statements, got %d: %q", len(statements), statements)
+	}
+	if statements[0] != "CREATE TABLE a (id INT)" || statements[1] != "CREATE INDEX b ON a (id)" {
+		t.Fatalf("unexpected statements %q", statements)
+	}
+}
@@ -1,4 +1,3 @@
-
 CREATE TABLE IF NOT EXISTS webhook_stats
 (
     webhook      VARCHAR(96)    NOT NULL,
@@ -7,4 +6,4 @@ CREATE TABLE IF NOT EXISTS webhook_stats
 
 
     PRIMARY KEY (webhook, query_id)
-)
\ No newline at end of file
+);
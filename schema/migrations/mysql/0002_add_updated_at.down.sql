@@ -0,0 +1,3 @@
+ALTER TABLE webhook_stats
+    DROP KEY webhook_stats_updated_at,
+    DROP COLUMN updated_at;
@@ -0,0 +1,3 @@
+ALTER TABLE webhook_stats
+    ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    ADD KEY webhook_stats_updated_at (updated_at);
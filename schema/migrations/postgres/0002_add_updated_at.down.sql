@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS webhook_stats_updated_at;
+
+ALTER TABLE webhook_stats DROP COLUMN IF EXISTS updated_at;
@@ -0,0 +1,3 @@
+ALTER TABLE webhook_stats ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS webhook_stats_updated_at ON webhook_stats (updated_at);
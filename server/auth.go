@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the timestamp, a dot and the request body, as "sha256=<hex>".
+	SignatureHeader = "X-Webhook-Signature"
+	// TimestampHeader carries the Unix time the request was signed at, so captured requests can't be replayed later.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// SignatureTolerance is how far the signed timestamp may be from the current time.
+	SignatureTolerance = 5 * time.Minute
+	// MaxSignedBodySize caps the body read to check a signature, before the caller is known.
+	MaxSignedBodySize = 32 << 20
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request has none of the credentials it checks,
+	// so the next one can be tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrForbidden is wrapped by an Authenticator when the caller is known, but not allowed in. It gets a 403
+	// rather than a 401.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Authenticator checks the credentials of a request to /query and /query/batch, returning who made it.
+type Authenticator interface {
+	Authenticate(r *http.Request) (identity string, err error)
+}
+
+// AuthenticatorFunc adapts a function to an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (string, error) {
+	return f(r)
+}
+
+// BearerTokens accepts requests with an "Authorization: Bearer <token>" header matching one of tokens.
+// Identities are reported as "token:<n>", the position of the token, so tokens never end up in logs.
+func BearerTokens(tokens ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		header := r.Header.Get("Authorization")
+		scheme, token, found := strings.Cut(header, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return "", ErrNoCredentials
+		}
+		for i, expected := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				return fmt.Sprintf("token:%d", i), nil
+			}
+		}
+		return "", errors.New("unknown bearer token")
+	})
+}
+
+// HMACSignatures accepts requests whose SignatureHeader is the HMAC-SHA256 under one of secrets of TimestampHeader,
+// a dot and the body, signed within SignatureTolerance of now. Identities are reported as "hmac:<n>", the position
+// of the secret.
+func HMACSignatures(secrets ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		header := r.Header.Get(SignatureHeader)
+		if header == "" {
+			return "", ErrNoCredentials
+		}
+		encoded, found := strings.CutPrefix(header, "sha256=")
+		signature, err := hex.DecodeString(encoded)
+		if !found || err != nil {
+			return "", fmt.Errorf("malformed %s header", SignatureHeader)
+		}
+		timestamp := r.Header.Get(TimestampHeader)
+		signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("missing or malformed %s header", TimestampHeader)
+		}
+		if age := time.Since(time.Unix(signedAt, 0)); age > SignatureTolerance || age < -SignatureTolerance {
+			return "", fmt.Errorf("signature timestamp is %s away from now", age.Round(time.Second))
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, MaxSignedBodySize))
+		if err != nil {
+			return "", fmt.Errorf("reading body: %w", err)
+		}
+		// Put the body back for the handler.
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		for i, secret := range secrets {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(timestamp + "."))
+			mac.Write(body)
+			if hmac.Equal(signature, mac.Sum(nil)) {
+				return fmt.Sprintf("hmac:%d", i), nil
+			}
+		}
+		return "", errors.New("signature does not match the body")
+	})
+}
+
+// ClientCertificates accepts requests made over TLS with a verified client certificate, see TLSFiles.ClientCAFile.
+// The identity is the certificate's common name. If names are given, other identities are forbidden.
+func ClientCertificates(names ...string) Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (string, error) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return "", ErrNoCredentials
+		}
+		identity := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if len(names) == 0 {
+			return identity, nil
+		}
+		for _, name := range names {
+			if identity == name {
+				return identity, nil
+			}
+		}
+		return identity, fmt.Errorf("%w: client certificate %q is not allowed", ErrForbidden, identity)
+	})
+}
+
+// authenticate runs the configured authenticators, the first one to recognise its credentials deciding.
+// Rejected requests are answered with 401 or 403, logged for auditing, and false is returned.
+// Without any authenticators every request is let through.
+func (q *WebhookQueryHandler) authenticate(w http.ResponseWriter, r *http.Request) bool {
+	authenticators := q.current().authenticators
+	if len(authenticators) == 0 {
+		return true
+	}
+
+	logger := logging.FromContext(r.Context())
+	err := ErrNoCredentials
+	var identity string
+	for _, authenticator := range authenticators {
+		identity, err = authenticator.Authenticate(r)
+		if !errors.Is(err, ErrNoCredentials) {
+			break
+		}
+	}
+	if err == nil {
+		logger.Debug("Authenticated request", "identity", identity)
+		return true
+	}
+
+	logger.Warn("Rejected request", "audit", true, "reason", err.Error(), "identity", identity,
+		"remote_addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path, "user_agent", r.UserAgent())
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+	} else if errors.Is(err, ErrForbidden) {
+		helpers.ForbiddenHandler(w, r)
+	} else {
+		helpers.UnauthorizedHandler(w, r)
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authBody has no commands, so requests that get past authentication are rejected by validation with a 400.
+// That the error is about the commands also shows the body survived being read for its signature.
+const authBody = `{"commands":{"query_id":"auth-test"},"event":{}}`
+
+const accepted = http.StatusBadRequest
+
+// sign signs body as if at signedAt, setting the signature and timestamp headers on r.
+func sign(r *http.Request, secret string, signedAt time.Time, body string) *http.Request {
+	timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	r.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	r.Header.Set(TimestampHeader, timestamp)
+	return r
+}
+
+func withClientCert(r *http.Request, name string) *http.Request {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestAuthenticators(t *testing.T) {
+	var logs bytes.Buffer
+	srv := New(
+		WithLogger(slog.New(slog.NewTextHandler(&logs, nil))),
+		WithAuthenticators(ClientCertificates("upstream"), BearerTokens("first", "second"), HMACSignatures("secret")),
+	)
+
+	tests := []struct {
+		name    string
+		request func(r *http.Request) *http.Request
+		code    int
+	}{
+		{"no credentials", func(r *http.Request) *http.Request { return r }, http.StatusUnauthorized},
+		{"unknown token", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer third")
+			return r
+		}, http.StatusUnauthorized},
+		{"known token", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer second")
+			return r
+		}, accepted},
+		{"bad signature", func(r *http.Request) *http.Request {
+			return sign(r, "other", time.Now(), authBody)
+		}, http.StatusUnauthorized},
+		{"malformed signature", func(r *http.Request) *http.Request {
+			r.Header.Set(SignatureHeader, "md5=abc")
+			return r
+		}, http.StatusUnauthorized},
+		{"good signature", func(r *http.Request) *http.Request {
+			return sign(r, "secret", time.Now(), authBody)
+		}, accepted},
+		{"stale signature", func(r *http.Request) *http.Request {
+			return sign(r, "secret", time.Now().Add(-SignatureTolerance-time.Minute), authBody)
+		}, http.StatusUnauthorized},
+		{"signature without timestamp", func(r *http.Request) *http.Request {
+			r = sign(r, "secret", time.Now(), authBody)
+			r.Header.Del(TimestampHeader)
+			return r
+		}, http.StatusUnauthorized},
+		{"changed timestamp", func(r *http.Request) *http.Request {
+			r = sign(r, "secret", time.Now(), authBody)
+			r.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+			return r
+		}, http.StatusUnauthorized},
+		{"allowed client certificate", func(r *http.Request) *http.Request {
+			return withClientCert(r, "upstream")
+		}, accepted},
+		{"other client certificate", func(r *http.Request) *http.Request {
+			// A certificate that isn't allowed is forbidden, even with a good token alongside it.
+			r.Header.Set("Authorization", "Bearer first")
+			return withClientCert(r, "stranger")
+		}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := httptest.NewRecorder()
+			srv.ServeHTTP(res, test.request(httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(authBody))))
+			if res.Code != test.code {
+				t.Errorf("expected %d, got %d: %s", test.code, res.Code, res.Body.String())
+			}
+		})
+	}
+
+	if !strings.Contains(logs.String(), "identity=stranger") || !strings.Contains(logs.String(), "audit=true") {
+		t.Errorf("expected rejected requests to be audit logged, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "third") {
+		t.Errorf("expected tokens to be kept out of the logs, got:\n%s", logs.String())
+	}
+
+	large := strings.Repeat(" ", MaxSignedBodySize) + authBody
+	res := httptest.NewRecorder()
+	srv.ServeHTTP(res, sign(httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(large)), "secret", time.Now(), large))
+	if res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a body over the limit to be rejected before it is read in full, got %d", res.Code)
+	}
+
+	res = httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/livez", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("expected health checks to stay open, got %d", res.Code)
+	}
+
+	srv.Reload()
+	res = httptest.NewRecorder()
+	srv.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(authBody)))
+	if res.Code != accepted {
+		t.Errorf("expected a reload without authenticators to open /query, got %d", res.Code)
+	}
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
+	"github.com/DeltaScratchpad/webhook-interface/processing"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Per-item results reported by /query/batch
+const (
+	BatchProcessed = "processed"
+	BatchQueued    = "queued"
+	BatchInvalid   = "invalid"
+	BatchQueueFull = "queue_full"
+)
+
+type BatchItemResult struct {
+	Index   int    `json:"index"`
+	QueryId string `json:"query_id,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchItemResult `json:"results"`
+}
+
+// HandleBatch accepts a JSON array or an NDJSON stream of ProcessingEvents.
+// Invalid items are reported in the response and to their error URL, without failing the rest of the batch.
+func (q *WebhookQueryHandler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context())
+	maxItems := q.ingest.MaxBatchSize
+	if maxItems <= 0 {
+		maxItems = DefaultMaxBatchSize
+	}
+	maxBytes := q.ingest.MaxBatchBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBatchBytes
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	items, err := readBatch(r, maxItems)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		logger.Warn("Rejecting batch over the size limit", "limit", tooLarge.Limit)
+		helpers.RequestEntityTooLargeHandler(w, r)
+		return
+	}
+	if err != nil {
+		logger.Warn("Error parsing batch", "error", err)
+		helpers.BadRequestHandler(w, r, err)
+		return
+	}
+
+	response := BatchResponse{Results: make([]BatchItemResult, len(items))}
+	events := make([]*go_system_api.ProcessingEvent, len(items))
+	contexts := make([]context.Context, len(items))
+	var invalid []func()
+	// Invalid items are reported to their error URL once the response has been written.
+	defer func() {
+		for _, report := range invalid {
+			report()
+		}
+	}()
+	for i, item := range items {
+		result := &response.Results[i]
+		result.Index = i
+
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+		var query go_system_api.ProcessingEvent
+		if err := json.Unmarshal(item, &query); err != nil {
+			result.Status = BatchInvalid
+			result.Error = fmt.Sprintf("invalid JSON: %s", err)
+			continue
+		}
+		result.QueryId = query.Commands.QueryId
+
+		itemLogger := logger.With("query_id", query.Commands.QueryId, "step", query.Commands.Step, "batch_index", i)
+		ctx := logging.WithContext(r.Context(), itemLogger)
+		if err := helpers.ValidateProcessingEvent(&query); err != nil {
+			itemLogger.Warn("Rejecting invalid query in batch", "error", err)
+			invalid = append(invalid, func() { q.reportInvalid(ctx, &query, err) })
+			result.Status = BatchInvalid
+			result.Error = err.Error()
+			continue
+		}
+		events[i] = &query
+		contexts[i] = ctx
+	}
+
+	if q.queue != nil {
+		for i, event := range events {
+			if event == nil {
+				continue
+			}
+			// The request context is cancelled once the response is written, but processing continues after that.
+			if q.queue.TrySubmit(queuedEvent{ctx: context.WithoutCancel(contexts[i]), query: *event}) {
+				response.Results[i].Status = BatchQueued
+			} else {
+				response.Results[i].Status = BatchQueueFull
+				response.Results[i].Error = "queue is full, retry later"
+			}
+		}
+		q.writeBatchResponse(w, r, &response, http.StatusAccepted)
+		return
+	}
+
+	// Track the events until they are forwarded, so shutdown can drain or spool them.
+	pendingIDs := make([]uint64, len(events))
+	for i, event := range events {
+		if event != nil {
+			pendingIDs[i] = q.pending.Add(*event)
+		}
+	}
+
+	q.processBatch(contexts, events)
+	for i, event := range events {
+		if event != nil {
+			q.pending.Processed(pendingIDs[i])
+			response.Results[i].Status = BatchProcessed
+		}
+	}
+
+	go func() {
+		// Release anything left behind by a panic, it has been logged and won't be retried.
+		defer func() {
+			for i, event := range events {
+				if event != nil {
+					q.pending.Done(pendingIDs[i])
+				}
+			}
+		}()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.Error("Recovered from panic while forwarding batch", "panic", recovered, "stack", string(debug.Stack()))
+			}
+		}()
+		// The request context is cancelled once the response is written, but forwarding continues after that.
+		forwardBatch(context.WithoutCancel(r.Context()), q.ingest.BatchEndpoints, contexts, events, func(i int) { q.pending.Done(pendingIDs[i]) })
+	}()
+
+	q.writeBatchResponse(w, r, &response, http.StatusOK)
+}
+
+func (q *WebhookQueryHandler) writeBatchResponse(w http.ResponseWriter, r *http.Request, response *BatchResponse, status int) {
+	for _, result := range response.Results {
+		metrics.BatchItems.WithLabelValues(result.Status).Inc()
+		if result.Status == BatchProcessed || result.Status == BatchQueued {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+	}
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// processBatch evaluates the valid events concurrently, with as many workers as async ingest would use.
+func (q *WebhookQueryHandler) processBatch(contexts []context.Context, events []*go_system_api.ProcessingEvent) {
+	workers := q.ingest.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				func() {
+					defer func() {
+						if recovered := recover(); recovered != nil {
+							logging.FromContext(contexts[i]).Error("Recovered from panic while processing batch item", "panic", recovered, "stack", string(debug.Stack()))
+						}
+					}()
+					processing.ProcessProcessingEvent(contexts[i], events[i], q.webhookState)
+				}()
+			}
+		}()
+	}
+	for i, event := range events {
+		if event != nil {
+			indexes <- i
+		}
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// forwardBatch groups events by their next step, sending each group as one request when a batch endpoint is
+// configured for that step, and forwarding them one at a time otherwise. Events the batch endpoint doesn't accept
+// are given up on like any other failed forward, unless it turns out not to take batches.
+func forwardBatch(ctx context.Context, batchEndpoints map[string]string, contexts []context.Context, events []*go_system_api.ProcessingEvent, forwarded func(i int)) {
+	groups := make(map[string][]int)
+	var order []string
+	for i, event := range events {
+		if event == nil {
+			continue
+		}
+		if !helpers.HasNextStep(event) {
+			// The end of the pipeline, there is nothing to forward.
+			forwarded(i)
+			continue
+		}
+		next_url := event.Commands.Commands[event.Commands.Step+1].Url
+		if _, ok := groups[next_url]; !ok {
+			order = append(order, next_url)
+		}
+		groups[next_url] = append(groups[next_url], i)
+	}
+
+	for _, next_url := range order {
+		indexes := groups[next_url]
+		if batch_url := batchEndpoints[next_url]; batch_url != "" && len(indexes) > 1 {
+			group := make([]*go_system_api.ProcessingEvent, 0, len(indexes))
+			for _, i := range indexes {
+				group = append(group, events[i])
+			}
+			failed, err := helpers.ForwardBatch(ctx, batch_url, group)
+			if errors.Is(err, helpers.ErrBatchUnsupported) {
+				logging.FromContext(ctx).Info("Falling back to forwarding batch items individually", "url", batch_url, "error", err)
+				for _, f := range failed {
+					helpers.ForwardEvent(context.WithoutCancel(contexts[indexes[f]]), events[indexes[f]])
+				}
+			} else if err != nil {
+				metrics.ForwardFailures.Add(float64(len(failed)))
+				logging.FromContext(ctx).Error("Giving up forwarding batch items", "url", batch_url, "failed", len(failed), "error", err)
+			}
+			for _, i := range indexes {
+				forwarded(i)
+			}
+			continue
+		}
+		for _, i := range indexes {
+			helpers.ForwardEvent(context.WithoutCancel(contexts[i]), events[i])
+			forwarded(i)
+		}
+	}
+}
+
+// readBatch splits the request body into raw items, either from a JSON array or from one JSON document per line.
+func readBatch(r *http.Request, maxItems int) ([]jsoniter.RawMessage, error) {
+	reader := bufio.NewReader(r.Body)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	ndjson := mediaType == "application/x-ndjson" || mediaType == "application/jsonl"
+
+	if !ndjson {
+		// Sniff the first non-whitespace byte, so clients that don't set a content type still work.
+		for {
+			b, err := reader.ReadByte()
+			if err == io.EOF {
+				return nil, fmt.Errorf("empty batch")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+				continue
+			}
+			_ = reader.UnreadByte()
+			ndjson = b != '['
+			break
+		}
+	}
+
+	var items []jsoniter.RawMessage
+	if ndjson {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == maxItems {
+				return nil, fmt.Errorf("batch has more than %d items", maxItems)
+			}
+			items = append(items, append(jsoniter.RawMessage(nil), line...))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("invalid NDJSON body: %w", err)
+		}
+	} else {
+		// Read the array an item at a time, so a batch with too many items is turned away without reading all of it.
+		decoder := json.NewDecoder(reader)
+		if token, err := decoder.Token(); err != nil {
+			return nil, fmt.Errorf("invalid JSON array body: %w", err)
+		} else if token != json.Delim('[') {
+			return nil, fmt.Errorf("invalid JSON array body: expected an array")
+		}
+		for decoder.More() {
+			if len(items) == maxItems {
+				return nil, fmt.Errorf("batch has more than %d items", maxItems)
+			}
+			var item json.RawMessage
+			if err := decoder.Decode(&item); err != nil {
+				return nil, fmt.Errorf("invalid JSON array body: %w", err)
+			}
+			items = append(items, jsoniter.RawMessage(item))
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, fmt.Errorf("invalid JSON array body: %w", err)
+		}
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	return items, nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+func TestBatchEndpoint(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]go_system_api.ProcessingEvent
+	var singles int
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/batch") {
+			var batch []go_system_api.ProcessingEvent
+			_ = json.NewDecoder(r.Body).Decode(&batch)
+			batches = append(batches, batch)
+			return
+		}
+		singles++
+	}))
+	defer next.Close()
+
+	handler := &WebhookQueryHandler{
+		webhookState: webhook_tracker.NewLocalWebhookState(),
+		pending:      newPendingEvents(),
+		ingest:       IngestConfig{Workers: 2, BatchEndpoints: map[string]string{next.URL + "/query": next.URL + "/query/batch"}},
+	}
+
+	item := func(queryID string) string {
+		event := go_system_api.ProcessingEvent{
+			Commands: go_system_api.CommandList{
+				QueryId: queryID,
+				Commands: []go_system_api.CommandStep{
+					{CommandName: "webhook", Args: "fieldname>=100 http://localhost:1/never"},
+					{CommandName: "next", Url: next.URL + "/query"},
+				},
+			},
+			Event: go_system_api.EventData{Derived: map[string]interface{}{"fieldname": 1}},
+		}
+		data, _ := json.Marshal(event)
+		return string(data)
+	}
+	body := fmt.Sprintf("%s\n{\"commands\":{\"query_id\":\"bad\"}}\n%s\n", item("first"), item("second"))
+
+	req := httptest.NewRequest(http.MethodPost, "/query/batch", strings.NewReader(body)).WithContext(allowLoopback(context.Background()))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	res := httptest.NewRecorder()
+	handler.BatchHandler().ServeHTTP(res, req)
+	handler.pending.Wait(context.Background())
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", res.Code, res.Body.String())
+	}
+	var summary BatchResponse
+	if err := json.NewDecoder(res.Body).Decode(&summary); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+	if summary.Accepted != 2 || summary.Rejected != 1 {
+		t.Fatalf("expected 2 accepted and 1 rejected, got %+v", summary)
+	}
+	if summary.Results[1].Status != BatchInvalid || summary.Results[1].Error == "" {
+		t.Fatalf("expected item 1 to be invalid with an error, got %+v", summary.Results[1])
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(batches) != 1 || len(batches[0]) != 2 || singles != 0 {
+		t.Fatalf("expected one forwarded batch of 2 events, got %d batches and %d single events", len(batches), singles)
+	}
+	if batches[0][0].Commands.Step != 1 {
+		t.Fatalf("expected forwarded events to be on step 1, got %d", batches[0][0].Commands.Step)
+	}
+}
+
+func TestForwardBatchRetriesOnlyFailedItems(t *testing.T) {
+	var lock sync.Mutex
+	var batches [][]string
+	var singles int
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Path != "/query/batch" {
+			singles++
+			return
+		}
+		var batch []go_system_api.ProcessingEvent
+		_ = json.NewDecoder(r.Body).Decode(&batch)
+		response := BatchResponse{}
+		var ids []string
+		for i, event := range batch {
+			ids = append(ids, event.Commands.QueryId)
+			status := BatchQueued
+			// The first request turns the second item away, as a next step with a full queue does.
+			if len(batches) == 0 && i == 1 {
+				status = BatchQueueFull
+			}
+			response.Results = append(response.Results, BatchItemResult{Index: i, Status: status})
+		}
+		batches = append(batches, ids)
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer next.Close()
+
+	events := make([]*go_system_api.ProcessingEvent, 0, 3)
+	contexts := make([]context.Context, 0, 3)
+	for _, queryID := range []string{"first", "second", "third"} {
+		events = append(events, &go_system_api.ProcessingEvent{Commands: go_system_api.CommandList{
+			QueryId:  queryID,
+			Commands: []go_system_api.CommandStep{{CommandName: "webhook"}, {CommandName: "next", Url: next.URL + "/query"}},
+		}})
+		contexts = append(contexts, allowLoopback(context.Background()))
+	}
+	ctx := helpers.WithRetryPolicy(allowLoopback(context.Background()), helpers.RetryPolicy{ForwardAttempts: 3})
+	seen := func() ([][]string, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([][]string(nil), batches...), singles
+	}
+
+	var forwarded int
+	forwardBatch(ctx, map[string]string{next.URL + "/query": next.URL + "/query/batch"}, contexts, events, func(int) { forwarded++ })
+	if got, single := seen(); len(got) != 2 || strings.Join(got[1], ",") != "second" || single != 0 {
+		t.Fatalf("expected the rejected item alone to be retried as a batch, got batches %v and %d single events", got, single)
+	}
+	if forwarded != 3 {
+		t.Errorf("expected all 3 events to be done, got %d", forwarded)
+	}
+
+	// Without a configured batch endpoint, events are forwarded one at a time.
+	forwardBatch(ctx, nil, contexts, events, func(int) {})
+	if got, single := seen(); len(got) != 2 || single != 3 {
+		t.Errorf("expected 3 single events and no new batch, got %d batches and %d single events", len(got), single)
+	}
+}
+
+func TestBatchLimits(t *testing.T) {
+	handler := &WebhookQueryHandler{
+		webhookState: webhook_tracker.NewLocalWebhookState(),
+		pending:      newPendingEvents(),
+		ingest:       IngestConfig{MaxBatchSize: 2, MaxBatchBytes: 1024},
+	}
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/query/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res := httptest.NewRecorder()
+		handler.BatchHandler().ServeHTTP(res, req)
+		return res
+	}
+
+	if res := post("[" + strings.Repeat(" ", 2048) + "]"); res.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 for a body over the size limit, got %d: %s", res.Code, res.Body.String())
+	}
+	// The array is rejected once it passes the item limit, before the broken JSON after it is read.
+	res := post(`[{}, {}, {}, {not json`)
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "more than 2 items") {
+		t.Errorf("expected 400 for too many items, got %d: %s", res.Code, res.Body.String())
+	}
+}
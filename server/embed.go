@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const DefaultAddr = ":80"
+
+// Server is the webhook stage as an http.Handler, which can be mounted in another service's mux,
+// or served on its own with Start. Either way, Shutdown drains the events it has accepted.
+type Server struct {
+	addr           string
+	prefix         string
+	state          webhook_tracker.WebhookState
+	readyProbes    map[string]string
+	ingest         IngestConfig
+	shutdown       ShutdownConfig
+	logger         *slog.Logger
+	webhookClient  *http.Client
+	forwardClient  *http.Client
+	retryPolicy    *helpers.RetryPolicy
+	authenticators []Authenticator
+	destinations   *destination.Registry
+	middleware     []func(http.Handler) http.Handler
+	tlsConfig      *tls.Config
+	tlsFiles       *TLSFiles
+	timeouts       HTTPTimeouts
+
+	queries   *WebhookQueryHandler
+	readiness *ReadinessHandler
+	handler   http.Handler
+	lock      sync.Mutex
+	srv       *http.Server
+	listener  net.Listener
+	stopWatch context.CancelFunc
+	retiring  sync.WaitGroup // Destinations replaced by Reload that are still being closed
+}
+
+type Option func(*Server)
+
+// HTTPTimeouts are passed on to the http.Server created by Start. Zero means no timeout.
+type HTTPTimeouts struct {
+	ReadHeader time.Duration
+	Read       time.Duration
+	Write      time.Duration
+	Idle       time.Duration
+}
+
+// WithAddr sets the address Start listens on, defaulting to DefaultAddr.
+func WithAddr(addr string) Option {
+	return func(s *Server) { s.addr = addr }
+}
+
+// WithState sets the webhook state backend, defaulting to in-memory state.
+func WithState(state webhook_tracker.WebhookState) Option {
+	return func(s *Server) { s.state = state }
+}
+
+// WithReadyProbes adds downstream URLs checked by /readyz, keyed by the name it reports them under.
+func WithReadyProbes(probes map[string]string) Option {
+	return func(s *Server) {
+		if s.readyProbes == nil {
+			s.readyProbes = make(map[string]string, len(probes))
+		}
+		for name, url := range probes {
+			s.readyProbes[name] = url
+		}
+	}
+}
+
+// WithIngest sets how /query and /query/batch take events, defaulting to sync ingest. Only applied by New.
+func WithIngest(ingest IngestConfig) Option {
+	return func(s *Server) { s.ingest = ingest }
+}
+
+// WithShutdown sets how long Shutdown drains accepted events, and where the rest are spooled. The drain timeout
+// defaults to DefaultDrainTimeout. Only applied by New.
+func WithShutdown(shutdown ShutdownConfig) Option {
+	return func(s *Server) { s.shutdown = shutdown }
+}
+
+// WithLogger sets the logger requests and background work log to, defaulting to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) { s.logger = logger }
+}
+
+// WithWebhookClient sets the client used to call webhooks. The default blocks private, loopback and link-local
+// addresses, see egress.Policy.
+func WithWebhookClient(client *http.Client) Option {
+	return func(s *Server) { s.webhookClient = client }
+}
+
+// WithForwardClient sets the client used to forward events and report errors. The default allows private and loopback
+// addresses, as the steps of a pipeline often run on an internal network, and blocks link-local ones.
+func WithForwardClient(client *http.Client) Option {
+	return func(s *Server) { s.forwardClient = client }
+}
+
+// WithRetryPolicy sets how often webhook calls and forwards are retried, defaulting to helpers.DefaultRetryPolicy.
+func WithRetryPolicy(policy helpers.RetryPolicy) Option {
+	return func(s *Server) { s.retryPolicy = &policy }
+}
+
+// WithAuthenticators requires requests to /query and /query/batch to pass one of authenticators.
+// Health checks and metrics stay open. Without authenticators anyone who can reach the server can send events.
+func WithAuthenticators(authenticators ...Authenticator) Option {
+	return func(s *Server) { s.authenticators = append(s.authenticators, authenticators...) }
+}
+
+// WithDestinations sets the destinations webhooks in args can refer to as @name.
+func WithDestinations(registry *destination.Registry) Option {
+	return func(s *Server) { s.destinations = registry }
+}
+
+// WithPrefix mounts every route under prefix, e.g. "/webhooks" serves /webhooks/query.
+func WithPrefix(prefix string) Option {
+	return func(s *Server) { s.prefix = "/" + strings.Trim(prefix, "/") }
+}
+
+// WithMiddleware wraps the routes, the first middleware being the outermost.
+// Panics in middleware are still turned into 500s by Recover.
+func WithMiddleware(middleware ...func(http.Handler) http.Handler) Option {
+	return func(s *Server) { s.middleware = append(s.middleware, middleware...) }
+}
+
+// WithTLSConfig makes Start serve HTTPS. The config must have a certificate, or a way to get one.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) { s.tlsConfig = config }
+}
+
+// WithTLSFiles makes Start serve HTTPS from files, reloading them when they are rotated.
+// It takes precedence over WithTLSConfig.
+func WithTLSFiles(files TLSFiles) Option {
+	return func(s *Server) { s.tlsFiles = &files }
+}
+
+// WithHTTPTimeouts sets the timeouts of the server created by Start.
+func WithHTTPTimeouts(timeouts HTTPTimeouts) Option {
+	return func(s *Server) { s.timeouts = timeouts }
+}
+
+// New builds the server. In async ingest mode the workers start straight away, so call Shutdown when done.
+func New(opts ...Option) *Server {
+	s := &Server{addr: DefaultAddr}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.state == nil {
+		s.state = webhook_tracker.NewLocalWebhookState()
+	}
+	if s.prefix == "/" {
+		s.prefix = ""
+	}
+	if s.shutdown.DrainTimeout <= 0 {
+		s.shutdown.DrainTimeout = DefaultDrainTimeout
+	}
+
+	s.queries = &WebhookQueryHandler{
+		webhookState: s.state,
+		pending:      newPendingEvents(),
+		ingest:       s.ingest,
+	}
+	s.readiness = NewReadinessHandler(s.state, nil)
+	s.applySettings()
+	if s.ingest.Mode == IngestAsync {
+		s.queries.queue = newEventQueue(s.ingest, s.state, s.queries.pending)
+		s.queries.current().logger.Info("Using async ingest", "workers", s.ingest.Workers, "queue_size", s.ingest.QueueSize)
+	}
+
+	//Create request multiplexer
+	mux := http.NewServeMux()
+
+	//Add handler to multiplexer
+	mux.Handle(s.prefix+"/query", s.queries)
+	mux.Handle(s.prefix+"/query/", s.queries)
+	mux.Handle(s.prefix+"/query/batch", s.queries.BatchHandler())
+	mux.Handle(s.prefix+"/metrics", promhttp.Handler())
+	mux.HandleFunc(s.prefix+"/livez", LivenessHandler)
+	mux.HandleFunc(s.prefix+"/health", LivenessHandler) // Kept for existing deployments, same as /livez.
+	mux.Handle(s.prefix+"/readyz", s.readiness)
+
+	var handler http.Handler = mux
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		handler = s.middleware[i](handler)
+	}
+	s.handler = Recover(handler)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Start listens on the configured address and serves in the background until Shutdown.
+// Values on ctx are passed on to requests, but cancelling it doesn't stop the server.
+// Events spooled by a previous shutdown are replayed once listening.
+func (s *Server) Start(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.srv != nil {
+		return errors.New("server already started")
+	}
+
+	tlsConfig := s.tlsConfig
+	stopWatch := func() {}
+	if s.tlsFiles != nil {
+		reloader, err := NewCertificateReloader(*s.tlsFiles)
+		if err != nil {
+			return err
+		}
+		var watchCtx context.Context
+		watchCtx, stopWatch = context.WithCancel(context.Background())
+		if err := reloader.Watch(watchCtx); err != nil {
+			stopWatch()
+			return err
+		}
+		tlsConfig = reloader.TLSConfig()
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		stopWatch()
+		return fmt.Errorf("listening on %s: %w", s.addr, err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	s.stopWatch = stopWatch
+	s.listener = listener
+	s.srv = &http.Server{
+		Handler:           s,
+		BaseContext:       func(net.Listener) context.Context { return context.WithoutCancel(ctx) },
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		ReadTimeout:       s.timeouts.Read,
+		WriteTimeout:      s.timeouts.Write,
+		IdleTimeout:       s.timeouts.Idle,
+	}
+
+	go func() {
+		if err := s.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.queries.current().logger.Error("Error serving", "addr", listener.Addr().String(), "error", err)
+		}
+	}()
+	s.queries.current().logger.Info("Starting server", "addr", listener.Addr().String(), "tls", tlsConfig != nil)
+
+	if s.shutdown.SpoolFile != "" {
+		s.queries.replaySpool(logging.WithContext(context.WithoutCancel(ctx), s.queries.current().logger), s.shutdown.SpoolFile)
+	}
+	return nil
+}
+
+// Addr returns the address the server is listening on, or the configured address before Start.
+func (s *Server) Addr() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener != nil {
+		return s.listener.Addr().String()
+	}
+	return s.addr
+}
+
+// Shutdown stops accepting requests, then waits for accepted events to be forwarded until ctx
+// or the drain timeout expires. Anything left is spooled or dropped, and reported in the error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.queries.current().logger.Info("Server Stopping", "drain_timeout", s.shutdown.DrainTimeout)
+
+	// One deadline covers both in-flight requests and the events accepted before them.
+	ctx, cancel := context.WithTimeout(ctx, s.shutdown.DrainTimeout)
+	defer cancel()
+
+	var err error
+	s.lock.Lock()
+	srv := s.srv
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	s.lock.Unlock()
+	// Stop accepting new requests first, so nothing new is added while draining.
+	if srv != nil {
+		if err = srv.Shutdown(ctx); err != nil {
+			s.queries.current().logger.Error("HTTP server did not stop cleanly, continuing to drain", "error", err)
+		}
+	}
+	err = errors.Join(err, s.queries.drain(ctx, s.shutdown))
+	// Send digests held back by destinations, now that no more events will be added to them, and disconnect from brokers.
+	err = errors.Join(err, s.queries.current().destinations.Close(ctx))
+	retired := make(chan struct{})
+	go func() {
+		s.retiring.Wait()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-ctx.Done():
+		err = errors.Join(err, fmt.Errorf("closing replaced destinations: %w", ctx.Err()))
+	}
+	s.queries.current().logger.Info("Server Stopped")
+	return err
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+)
+
+type countingTransport struct {
+	requests atomic.Int64
+}
+
+func (c *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	c.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestEmbeddedServerOptions(t *testing.T) {
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer next.Close()
+
+	var middlewareCalls atomic.Int64
+	webhooks := &countingTransport{}
+	forwards := &countingTransport{}
+	srv := New(
+		WithAddr("127.0.0.1:0"),
+		WithPrefix("/webhooks/"),
+		WithWebhookClient(&http.Client{Transport: webhooks}),
+		WithForwardClient(&http.Client{Transport: forwards}),
+		WithMiddleware(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				middlewareCalls.Add(1)
+				h.ServeHTTP(w, r)
+			})
+		}),
+	)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+
+	event := go_system_api.ProcessingEvent{
+		Commands: go_system_api.CommandList{
+			QueryId: "embed-test",
+			Commands: []go_system_api.CommandStep{
+				{CommandName: "webhook", Args: "fieldname>=1 " + next.URL + "/webhook"},
+				{CommandName: "next", Url: next.URL},
+			},
+		},
+		Event: go_system_api.EventData{Derived: map[string]interface{}{"fieldname": 1}},
+	}
+	body, _ := json.Marshal(&event)
+	base := "http://" + srv.Addr()
+	// Without keep-alives, the client can't leave a spare connection open that would hold up Shutdown.
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	res, err := client.Post(base+"/query", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("posting without prefix: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected routes to only be served under the prefix, got %d", res.StatusCode)
+	}
+
+	res, err = client.Post(base+"/webhooks/query", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatalf("posting with prefix: %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("shutting down: %v", err)
+	}
+
+	if middlewareCalls.Load() != 2 {
+		t.Errorf("expected the middleware to see both requests, got %d", middlewareCalls.Load())
+	}
+	if webhooks.requests.Load() != 1 {
+		t.Errorf("expected the webhook to be called with the webhook client, got %d calls", webhooks.requests.Load())
+	}
+	if forwards.requests.Load() != 1 {
+		t.Errorf("expected the event to be forwarded with the forward client, got %d calls", forwards.requests.Load())
+	}
+	if _, err := http.Get(base + "/webhooks/livez"); err == nil {
+		t.Error("expected the server to stop listening after Shutdown")
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+const readinessTimeout = 2 * time.Second
+
+type ComponentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReadinessReport struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// ReadinessHandler reports whether the state backend, and any configured downstream URLs, are reachable.
+// Downstream URLs are reported under their names, so /readyz doesn't give them away.
+type ReadinessHandler struct {
+	webhookState webhook_tracker.WebhookState
+	lock         sync.RWMutex
+	probes       map[string]string
+	client       *http.Client
+}
+
+func NewReadinessHandler(state webhook_tracker.WebhookState, probes map[string]string) *ReadinessHandler {
+	return &ReadinessHandler{
+		webhookState: state,
+		probes:       probes,
+		client:       &http.Client{Timeout: readinessTimeout},
+	}
+}
+
+// SetProbes replaces the downstream URLs checked from the next request on, keyed by name.
+func (h *ReadinessHandler) SetProbes(probes map[string]string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.probes = probes
+}
+
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK"))
+}
+
+func (h *ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	report := h.Check(ctx)
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// Check runs every component check concurrently and collects the results.
+func (h *ReadinessHandler) Check(ctx context.Context) ReadinessReport {
+	h.lock.RLock()
+	probes := h.probes
+	h.lock.RUnlock()
+
+	report := ReadinessReport{
+		Status:     "ok",
+		Components: make(map[string]ComponentStatus, len(probes)+1),
+	}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+
+	record := func(name string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			report.Status = "error"
+			report.Components[name] = ComponentStatus{Status: "error", Error: err.Error()}
+		} else {
+			report.Components[name] = ComponentStatus{Status: "ok"}
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		record("state", h.webhookState.Ping(ctx))
+	}()
+
+	for name, target := range probes {
+		wg.Add(1)
+		go func(name string, target string) {
+			defer wg.Done()
+			record(name, h.probe(ctx, target))
+		}(name, target)
+	}
+
+	wg.Wait()
+	return report
+}
+
+// probe treats any response below 500 as healthy, as the downstream only needs to be reachable.
+func (h *ReadinessHandler) probe(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return withoutURL(err)
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return withoutURL(err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode >= 500 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// withoutURL leaves the URL out of a probe error, as /readyz only shows the name of the probe.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+// unreachableState is in-memory state whose backend can't be reached.
+type unreachableState struct {
+	webhook_tracker.WebhookState
+}
+
+func (unreachableState) Ping(ctx context.Context) error {
+	return errors.New("connection refused")
+}
+
+func readiness(t *testing.T, handler http.Handler) (int, ReadinessReport, string) {
+	t.Helper()
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	body := res.Body.String()
+	var report ReadinessReport
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("decoding readiness report: %s", err)
+	}
+	return res.Code, report, body
+}
+
+func TestReadinessReportsProbesByName(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Any response below 500 means the downstream is reachable.
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	handler := NewReadinessHandler(webhook_tracker.NewLocalWebhookState(), map[string]string{"next": healthy.URL})
+	code, report, _ := readiness(t, handler)
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Fatalf("expected the server to be ready, got %d %+v", code, report)
+	}
+	if report.Components["state"].Status != "ok" || report.Components["next"].Status != "ok" {
+		t.Errorf("expected the state backend and the next step to be ok, got %+v", report.Components)
+	}
+
+	handler.SetProbes(map[string]string{"next": healthy.URL, "archive": failing.URL, "search": closed.URL + "/query?token=s3cr3t"})
+	code, report, body := readiness(t, handler)
+	if code != http.StatusServiceUnavailable || report.Status != "error" {
+		t.Fatalf("expected the server to be unready, got %d %+v", code, report)
+	}
+	if report.Components["archive"].Status != "error" || report.Components["search"].Status != "error" || report.Components["next"].Status != "ok" {
+		t.Errorf("expected the failing probes to be reported under their names, got %+v", report.Components)
+	}
+	for _, target := range []string{healthy.URL, failing.URL, closed.URL, "s3cr3t"} {
+		if strings.Contains(body, target) {
+			t.Errorf("expected %s to be left out of the report, got %s", target, body)
+		}
+	}
+}
+
+func TestReadinessReportsUnreachableState(t *testing.T) {
+	handler := NewReadinessHandler(unreachableState{webhook_tracker.NewLocalWebhookState()}, nil)
+	code, report, _ := readiness(t, handler)
+	if code != http.StatusServiceUnavailable || report.Components["state"].Error != "connection refused" {
+		t.Fatalf("expected the unreachable state backend to make the server unready, got %d %+v", code, report)
+	}
+}
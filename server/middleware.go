@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+)
+
+// Recover turns a panic in next into a 500 response, so one bad event can't take down the server.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				// The request ID is set on the response by the handler that panicked, or passed in by the caller.
+				requestID := w.Header().Get("X-Request-ID")
+				if requestID == "" {
+					requestID = r.Header.Get("X-Request-ID")
+				}
+				if requestID == "" {
+					requestID = logging.NewRequestID()
+					w.Header().Set("X-Request-ID", requestID)
+				}
+				logging.FromContext(r.Context()).Error("Recovered from panic while handling request",
+					"request_id", requestID, "path", r.URL.Path, "panic", recovered, "stack", string(debug.Stack()))
+				helpers.InternalServerErrorHandler(w, r)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+)
+
+func TestRecoverLogsRequestID(t *testing.T) {
+	var logs bytes.Buffer
+	ctx := logging.WithContext(context.Background(), slog.New(slog.NewTextHandler(&logs, nil)))
+
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/query" {
+			w.Header().Set("X-Request-ID", "from-handler")
+		}
+		panic("bad event")
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, path, nil).WithContext(ctx))
+		return res
+	}
+
+	if res := serve("/query"); res.Code != http.StatusInternalServerError {
+		t.Fatalf("expected the panic to be turned into a 500, got %d", res.Code)
+	}
+	if !strings.Contains(logs.String(), "request_id=from-handler") {
+		t.Errorf("expected the panic to be logged with the request ID set by the handler, got %s", logs.String())
+	}
+
+	// Without a request ID from the handler or the caller, one is made up and returned, so the 500 can be traced.
+	logs.Reset()
+	res := serve("/readyz")
+	if requestID := res.Header().Get("X-Request-ID"); requestID == "" || !strings.Contains(logs.String(), "request_id="+requestID) {
+		t.Errorf("expected the panic to be logged with the request ID returned to the caller, got %q and %s", requestID, logs.String())
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
+	"github.com/DeltaScratchpad/webhook-interface/processing"
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+// Ingest modes for the /query endpoint
+const (
+	// IngestSync evaluates the event and fires the webhook before responding.
+	IngestSync = "sync"
+	// IngestAsync responds 202 once the event is validated and queued for a worker.
+	IngestAsync = "async"
+)
+
+type IngestConfig struct {
+	Mode      string
+	Workers   int
+	QueueSize int
+	// MaxBatchSize caps the number of events accepted by /query/batch, defaulting to DefaultMaxBatchSize.
+	MaxBatchSize int
+	// MaxBatchBytes caps the size of a /query/batch body, defaulting to DefaultMaxBatchBytes.
+	MaxBatchBytes int64
+	// BatchEndpoints maps the URL of a next step to the endpoint taking batches of its events. Batches are only
+	// forwarded to next steps listed here, the events of other steps are forwarded one at a time.
+	BatchEndpoints map[string]string
+}
+
+const (
+	DefaultMaxBatchSize  = 1000
+	DefaultMaxBatchBytes = 32 << 20
+)
+
+type queuedEvent struct {
+	ctx       context.Context
+	query     go_system_api.ProcessingEvent
+	pendingID uint64
+	release   func() // Releases the destinations on ctx once the event is done.
+}
+
+// eventQueue is a bounded queue of validated events, drained by a fixed pool of workers.
+type eventQueue struct {
+	events       chan queuedEvent
+	webhookState webhook_tracker.WebhookState
+	pending      *pendingEvents
+	workers      sync.WaitGroup
+	closeOnce    sync.Once
+	lock         sync.RWMutex
+	closed       bool
+	stopping     atomic.Bool // Set once the drain deadline passes, so queued events are left for the spool
+}
+
+func newEventQueue(config IngestConfig, state webhook_tracker.WebhookState, pending *pendingEvents) *eventQueue {
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	size := config.QueueSize
+	if size < 0 {
+		size = 0
+	}
+
+	queue := &eventQueue{
+		events:       make(chan queuedEvent, size),
+		webhookState: state,
+		pending:      pending,
+	}
+	queue.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	return queue
+}
+
+// TrySubmit queues an event without blocking. Returns false if the queue is full or closed.
+func (e *eventQueue) TrySubmit(event queuedEvent) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.closed {
+		return false
+	}
+	// Track the event before a worker can pick it up and mark it done.
+	event.pendingID = e.pending.Add(event.query)
+	event.release = destination.Hold(event.ctx)
+	select {
+	case e.events <- event:
+		metrics.QueueDepth.Inc()
+		return true
+	default:
+		event.release()
+		e.pending.Done(event.pendingID)
+		metrics.QueueRejected.Inc()
+		return false
+	}
+}
+
+// Close stops accepting events and waits for the workers to finish everything already queued,
+// or until ctx expires, after which workers stop picking up queued events.
+func (e *eventQueue) Close(ctx context.Context) {
+	e.closeOnce.Do(func() {
+		e.lock.Lock()
+		e.closed = true
+		close(e.events)
+		e.lock.Unlock()
+	})
+
+	finished := make(chan struct{})
+	go func() {
+		e.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		e.stopping.Store(true)
+	}
+}
+
+func (e *eventQueue) work() {
+	defer e.workers.Done()
+	for event := range e.events {
+		metrics.QueueDepth.Dec()
+		if e.stopping.Load() {
+			// Leave the event pending, so it is spooled rather than half processed.
+			event.release()
+			continue
+		}
+		processAndForward(event.ctx, &event.query, e.webhookState, e.pending, event.pendingID, nil)
+		event.release()
+		e.pending.Done(event.pendingID)
+	}
+}
+
+// processAndForward evaluates and forwards an event that has already been acknowledged,
+// so there is no handler left for the Recover middleware to protect. Evaluation is recorded in pending under id,
+// calling processed if it is set, and skipped for events that were spooled after it.
+func processAndForward(ctx context.Context, query *go_system_api.ProcessingEvent, state webhook_tracker.WebhookState, pending *pendingEvents, id uint64, processed func()) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logging.FromContext(ctx).Error("Recovered from panic while processing queued event", "panic", recovered, "stack", string(debug.Stack()))
+		}
+	}()
+	if !pending.IsProcessed(id) {
+		processing.ProcessProcessingEvent(ctx, query, state)
+		pending.Processed(id)
+		if processed != nil {
+			processed()
+		}
+	}
+	helpers.ForwardEvent(ctx, query)
+}
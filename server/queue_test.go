@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/egress"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+// allowLoopback lets ctx call test servers, which listen on loopback addresses that the default clients block.
+func allowLoopback(ctx context.Context) context.Context {
+	client := (&egress.Policy{AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}).Client(5 * time.Second)
+	return helpers.WithForwardClient(helpers.WithWebhookClient(ctx, client), client)
+}
+
+func TestEventQueueBackpressureAndDrain(t *testing.T) {
+	var forwarded atomic.Int64
+	received := make(chan struct{}, 10)
+	release := make(chan struct{})
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+		forwarded.Add(1)
+	}))
+	defer next.Close()
+
+	event := func() queuedEvent {
+		return queuedEvent{
+			ctx: allowLoopback(context.Background()),
+			query: go_system_api.ProcessingEvent{
+				Commands: go_system_api.CommandList{
+					QueryId: "queue-test",
+					Commands: []go_system_api.CommandStep{
+						{CommandName: "webhook", Args: "fieldname>=100 http://localhost:1/never"},
+						{CommandName: "next", Url: next.URL},
+					},
+				},
+				Event: go_system_api.EventData{Derived: map[string]interface{}{"fieldname": 1}},
+			},
+		}
+	}
+
+	queue := newEventQueue(IngestConfig{Mode: IngestAsync, Workers: 1, QueueSize: 1}, webhook_tracker.NewLocalWebhookState(), newPendingEvents())
+
+	if !queue.TrySubmit(event()) {
+		t.Fatal("first event was rejected")
+	}
+	// Wait for the worker to pick up the first event, so the next one sits in the queue.
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker never forwarded the first event")
+	}
+	if !queue.TrySubmit(event()) {
+		t.Fatal("second event was rejected while the queue had room")
+	}
+	if queue.TrySubmit(event()) {
+		t.Fatal("third event was accepted while the queue was full")
+	}
+
+	close(release)
+	queue.Close(context.Background())
+	if got := forwarded.Load(); got != 2 {
+		t.Fatalf("expected both accepted events to be forwarded before Close returned, got %d", got)
+	}
+	if queue.TrySubmit(event()) {
+		t.Fatal("event was accepted after the queue was closed")
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	"github.com/DeltaScratchpad/webhook-interface/helpers"
+)
+
+// runtimeSettings are the parts of the handler that can be swapped while requests are in flight.
+type runtimeSettings struct {
+	logger         *slog.Logger
+	webhookClient  *http.Client
+	forwardClient  *http.Client
+	retryPolicy    *helpers.RetryPolicy
+	authenticators []Authenticator
+	destinations   *destination.Registry
+}
+
+// current returns the settings in effect, falling back to the defaults for a handler built without New.
+func (q *WebhookQueryHandler) current() *runtimeSettings {
+	if settings := q.settings.Load(); settings != nil {
+		return settings
+	}
+	return &runtimeSettings{logger: slog.Default()}
+}
+
+func (s *Server) applySettings() {
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.queries.settings.Store(&runtimeSettings{
+		logger:         s.logger,
+		webhookClient:  s.webhookClient,
+		forwardClient:  s.forwardClient,
+		retryPolicy:    s.retryPolicy,
+		authenticators: s.authenticators,
+		destinations:   s.destinations,
+	})
+	s.readiness.SetProbes(s.readyProbes)
+}
+
+// Reload swaps the logger, HTTP clients, retry policy, ready probes, authenticators and destinations while the server runs.
+// Options not given go back to their defaults. Other options only take effect in New, and are ignored here.
+// Requests already in progress finish with the settings they started with.
+func (s *Server) Reload(opts ...Option) {
+	var updated Server
+	for _, opt := range opts {
+		opt(&updated)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if previous, next := s.destinations, updated.destinations; previous != nil && previous != next {
+		// Requests and queued events keep using the old destinations until they are done, and whatever those
+		// hold back, such as email digests, is still sent. Destinations carried over to next stay open.
+		s.retiring.Add(1)
+		go func() {
+			defer s.retiring.Done()
+			if err := previous.Retire(context.Background(), next); err != nil {
+				s.queries.current().logger.Error("Error closing replaced destinations", "error", err)
+			}
+		}()
+	}
+	s.logger = updated.logger
+	s.webhookClient = updated.webhookClient
+	s.forwardClient = updated.forwardClient
+	s.retryPolicy = updated.retryPolicy
+	s.readyProbes = updated.readyProbes
+	s.authenticators = updated.authenticators
+	s.destinations = updated.destinations
+	s.applySettings()
+}
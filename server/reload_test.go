@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReloadSwapsReadyProbes(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	srv := New(WithReadyProbes(map[string]string{"next": failing.URL}))
+	ready := func() int {
+		res := httptest.NewRecorder()
+		srv.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return res.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the failing probe to make the server unready, got %d", code)
+	}
+	srv.Reload()
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("expected the server to be ready once the probe was reloaded away, got %d", code)
+	}
+}
@@ -2,79 +2,92 @@ package server
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
 	"github.com/DeltaScratchpad/webhook-interface/helpers"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	"github.com/DeltaScratchpad/webhook-interface/metrics"
 	"github.com/DeltaScratchpad/webhook-interface/processing"
+	"github.com/DeltaScratchpad/webhook-interface/tracing"
 	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
-	"os"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func CreateServer(addr *string, port string, done <-chan os.Signal, state webhook_tracker.WebhookState) {
-	var handler = WebhookQueryHandler{
-		webhookState: state,
-		waitGroup:    new(sync.WaitGroup),
-	}
+type WebhookQueryHandler struct {
+	webhookState webhook_tracker.WebhookState
+	settings     atomic.Pointer[runtimeSettings] // Swapped by Server.Reload, read with current()
+	pending      *pendingEvents
+	queue        *eventQueue // Only set in async ingest mode
+	ingest       IngestConfig
 
-	//Create request multiplexer
-	mux := http.NewServeMux()
+	spoolLock    sync.Mutex
+	spoolWritten bool // Set once shutdown has spooled the pending events
 
-	//Add handler to multiplexer
-	mux.Handle("/query", &handler)
-	mux.Handle("/query/", &handler)
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("OK"))
-	})
+	reports sync.WaitGroup // Error reports for rejected events, sent after the response
+}
 
-	if addr != nil {
-		port = fmt.Sprintf("%s:%s", *addr, port)
-	} else {
-		port = fmt.Sprintf(":%s", port)
-	}
+// statusRecorder captures the response code so it can be reported in metrics.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
 
-	srv := &http.Server{
-		Addr:    port,
-		Handler: mux,
-	}
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %s\n", err)
-		}
-	}()
-	log.Println("Starting server on port " + port)
+func (q *WebhookQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q.serve(w, r, "query", "HandleQuery", q.HandleQuery)
+}
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	<-done
-	log.Println("Server Stopping")
+// BatchHandler serves /query/batch, sharing the request ID, tracing and metrics setup of /query.
+func (q *WebhookQueryHandler) BatchHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q.serve(w, r, "batch", "HandleBatch", q.HandleBatch)
+	})
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (q *WebhookQueryHandler) serve(w http.ResponseWriter, r *http.Request, endpoint string, spanName string, handle http.HandlerFunc) {
+	start := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
 	defer func() {
-		// extra handling here
-		cancel()
-		handler.waitGroup.Wait()
-		log.Println("Server Stopped")
+		metrics.QueryDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		metrics.QueryRequests.WithLabelValues(endpoint, strconv.Itoa(recorder.status)).Inc()
 	}()
+	w = recorder
 
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatalf("Server Shutdown Failed:%+v", err)
+	// Reuse the caller's request ID if there is one, so log lines can be correlated across stages.
+	requestID := r.Header.Get("X-Request-ID")
+	if requestID == "" {
+		requestID = logging.NewRequestID()
 	}
-}
+	w.Header().Set("X-Request-ID", requestID)
+	ctx := logging.WithContext(tracing.Extract(q.withOutbound(r.Context()), r.Header), q.current().logger.With("request_id", requestID))
+	ctx, span := tracing.Tracer().Start(ctx, spanName, trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.response.status_code", recorder.status))
+		span.End()
+	}()
+	r = r.WithContext(ctx)
+	// Keep the destinations open until the request is done, even if a reload replaces them.
+	defer destination.Hold(ctx)()
 
-type WebhookQueryHandler struct {
-	webhookState webhook_tracker.WebhookState
-	waitGroup    *sync.WaitGroup
-}
+	if !q.authenticate(w, r) {
+		return
+	}
 
-func (q *WebhookQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
-		q.HandleQuery(w, r)
+		handle(w, r)
 		return
 	default:
 		helpers.InvalidHttpMethodHandler(w, r)
@@ -82,23 +95,86 @@ func (q *WebhookQueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// withOutbound sets the HTTP clients, retry policy and destinations used for webhooks and forwarding on ctx.
+// The settings are captured when the request arrives, so a reload doesn't change them part way through an event.
+func (q *WebhookQueryHandler) withOutbound(ctx context.Context) context.Context {
+	settings := q.current()
+	if settings.webhookClient != nil {
+		ctx = helpers.WithWebhookClient(ctx, settings.webhookClient)
+	}
+	if settings.forwardClient != nil {
+		ctx = helpers.WithForwardClient(ctx, settings.forwardClient)
+	}
+	if settings.retryPolicy != nil {
+		ctx = helpers.WithRetryPolicy(ctx, *settings.retryPolicy)
+	}
+	if settings.destinations != nil {
+		ctx = destination.WithRegistry(ctx, settings.destinations)
+	}
+	return ctx
+}
+
 func (q *WebhookQueryHandler) HandleQuery(w http.ResponseWriter, r *http.Request) {
-	q.waitGroup.Add(1) // Increment the wait group to ensure the event is forwarded before quitting.
 	//Parse query
-	query, err := helpers.ParseProcessingEvent(w, r)
+	query, err := helpers.ParseProcessingEvent(r)
 	if err != nil {
-		log.Printf("Error parsing query: %s \n", err)
-		helpers.InternalServerErrorHandler(w, r)
+		// Without a valid body there is no error URL to report to, so the caller is the only one who can be told.
+		logging.FromContext(r.Context()).Warn("Error parsing query", "error", err)
+		helpers.BadRequestHandler(w, r, err)
 		return
 	}
 
-	//log.Println("Handling query")
+	logger := logging.FromContext(r.Context()).With("query_id", query.Commands.QueryId, "step", query.Commands.Step)
+	ctx := logging.WithContext(r.Context(), logger)
+
+	if err := helpers.ValidateProcessingEvent(&query); err != nil {
+		logger.Warn("Rejecting invalid query", "error", err)
+		helpers.BadRequestHandler(w, r, err)
+		q.reportInvalid(ctx, &query, err)
+		return
+	}
+
+	if q.queue != nil {
+		// The request context is cancelled once the response is written, but processing continues after that.
+		if !q.queue.TrySubmit(queuedEvent{ctx: context.WithoutCancel(ctx), query: query}) {
+			logger.Warn("Ingest queue is full, rejecting query")
+			helpers.TooManyRequestsHandler(w, r)
+			return
+		}
+		logger.Debug("Queued query")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	logger.Debug("Handling query")
+	// Track the event until it is forwarded, so shutdown can drain or spool it.
+	pendingID := q.pending.Add(query)
 	defer func() { // Ensure the event will be forwarded regardless of errors.
+		q.pending.Processed(pendingID)
 		go func() {
-			helpers.ForwardEvent(&query)
 			// Don't let the server exit until the event has been forwarded.
-			q.waitGroup.Done()
+			defer q.pending.Done(pendingID)
+			// This runs after the response, so the Recover middleware can't catch a panic here.
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					logger.Error("Recovered from panic while forwarding event", "panic", recovered, "stack", string(debug.Stack()))
+				}
+			}()
+			// The request context is cancelled once the response is written, but forwarding continues after that.
+			helpers.ForwardEvent(context.WithoutCancel(ctx), &query)
 		}()
 	}()
-	processing.ProcessProcessingEvent(&query, q.webhookState)
+	processing.ProcessProcessingEvent(ctx, &query, q.webhookState)
+}
+
+// reportInvalid sends the error report for a rejected event in the background, so the caller gets its 400
+// without waiting on the error URL. Shutdown waits for the reports along with the pending events.
+func (q *WebhookQueryHandler) reportInvalid(ctx context.Context, event *go_system_api.ProcessingEvent, err error) {
+	message := fmt.Sprintf("Invalid event: %s", err)
+	q.reports.Add(1)
+	go func() {
+		defer q.reports.Done()
+		// The request context is cancelled once the response is written, but the report is sent after that.
+		helpers.LogError(context.WithoutCancel(ctx), message, event)
+	}()
 }
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/destination"
+	jsoniter "github.com/json-iterator/go"
+)
+
+const DefaultDrainTimeout = 30 * time.Second
+
+type ShutdownConfig struct {
+	// DrainTimeout bounds how long shutdown waits for accepted events to be processed and forwarded.
+	DrainTimeout time.Duration
+	// SpoolFile receives events that were still pending when the drain timeout expired, one JSON
+	// document per line. They are replayed on the next start. If empty, pending events are dropped.
+	SpoolFile string
+}
+
+// pendingEvents tracks events that have been accepted but not yet forwarded, so they can be
+// persisted if the server has to stop before they finish.
+type pendingEvents struct {
+	lock   sync.Mutex
+	nextID uint64
+	events map[uint64]spooledEvent
+	wg     sync.WaitGroup
+}
+
+// spooledEvent is an event as received, and how far it got. It is written to the spool file as the event's
+// own JSON, with "processed" added once its condition was evaluated and webhook called, so that isn't repeated.
+type spooledEvent struct {
+	go_system_api.ProcessingEvent
+	Processed bool `json:"processed,omitempty"`
+}
+
+func newPendingEvents() *pendingEvents {
+	return &pendingEvents{
+		events: make(map[uint64]spooledEvent),
+	}
+}
+
+// Add records a copy of the event as received, and returns the ID to pass to Done once it has been forwarded.
+func (p *pendingEvents) Add(event go_system_api.ProcessingEvent) uint64 {
+	return p.add(spooledEvent{ProcessingEvent: event})
+}
+
+func (p *pendingEvents) add(event spooledEvent) uint64 {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.nextID++
+	p.events[p.nextID] = event
+	p.wg.Add(1)
+	return p.nextID
+}
+
+// Processed records that the event's condition has been evaluated, so only forwarding is left.
+func (p *pendingEvents) Processed(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if event, ok := p.events[id]; ok {
+		event.Processed = true
+		p.events[id] = event
+	}
+}
+
+// IsProcessed reports whether Processed was called for the event, or it was spooled after that.
+func (p *pendingEvents) IsProcessed(id uint64) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.events[id].Processed
+}
+
+func (p *pendingEvents) Done(id uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.events[id]; ok {
+		delete(p.events, id)
+		p.wg.Done()
+	}
+}
+
+// Wait blocks until every pending event is done or ctx expires. Returns false if ctx expired first.
+func (p *pendingEvents) Wait(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Snapshot returns the events that are still pending, of those with the given IDs if any are given.
+func (p *pendingEvents) Snapshot(ids ...uint64) []spooledEvent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	events := make([]spooledEvent, 0, len(p.events))
+	if len(ids) > 0 {
+		for _, id := range ids {
+			if event, ok := p.events[id]; ok {
+				events = append(events, event)
+			}
+		}
+		return events
+	}
+	for _, event := range p.events {
+		events = append(events, event)
+	}
+	return events
+}
+
+// drain stops the async queue, waits for pending events until ctx expires, and persists whatever is left.
+// Returns an error if any events were left, whether or not they could be spooled.
+func (q *WebhookQueryHandler) drain(ctx context.Context, config ShutdownConfig) error {
+	if q.queue != nil {
+		q.queue.Close(ctx)
+	}
+	reported := make(chan struct{})
+	go func() {
+		q.reports.Wait()
+		close(reported)
+	}()
+	select {
+	case <-reported:
+	case <-ctx.Done():
+		q.current().logger.Warn("Drain timeout expired before invalid events were reported")
+	}
+	if q.pending.Wait(ctx) {
+		q.current().logger.Info("Drained all pending events")
+		return nil
+	}
+
+	// Anything still in flight may yet be forwarded, so spooled events are delivered at least once.
+	// Events being replayed are pending too, so they are kept in the spool written here.
+	q.spoolLock.Lock()
+	defer q.spoolLock.Unlock()
+	q.spoolWritten = true
+	remaining := q.pending.Snapshot()
+	queryIDs := make([]string, 0, len(remaining))
+	for _, event := range remaining {
+		queryIDs = append(queryIDs, event.Commands.QueryId)
+	}
+
+	if config.SpoolFile == "" {
+		q.current().logger.Error("Drain timeout expired, dropping pending events", "dropped", len(remaining), "query_ids", queryIDs)
+		return fmt.Errorf("drain timed out, dropped %d events", len(remaining))
+	}
+	if err := writeSpool(config.SpoolFile, remaining); err != nil {
+		q.current().logger.Error("Drain timeout expired and pending events could not be spooled, dropping them",
+			"dropped", len(remaining), "query_ids", queryIDs, "spool_file", config.SpoolFile, "error", err)
+		return fmt.Errorf("drain timed out, dropped %d events that could not be spooled: %w", len(remaining), err)
+	}
+	q.current().logger.Warn("Drain timeout expired, spooled pending events for the next start",
+		"spooled", len(remaining), "query_ids", queryIDs, "spool_file", config.SpoolFile)
+	return fmt.Errorf("drain timed out, spooled %d events to %s", len(remaining), config.SpoolFile)
+}
+
+// writeSpool replaces the spool file with events, removing it if there are none. The new file is written
+// beside it and renamed over it, so a crash leaves either the old file or the new one.
+func writeSpool(path string, events []spooledEvent) error {
+	if len(events) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, event := range events {
+		if err := encoder.Encode(&event); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readSpool loads the spool file. It is left in place, replaySpool updates it as the events are handled.
+func readSpool(path string) ([]spooledEvent, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var events []spooledEvent
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var event spooledEvent
+		if err := decoder.Decode(&event); err != nil {
+			return nil, fmt.Errorf("reading spool file %s: %w", path, err)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// updateSpool rewrites the spool file with the replayed events that are still pending, and how far they got.
+// Once shutdown has written the spool, it holds every pending event, so it is left alone.
+func (q *WebhookQueryHandler) updateSpool(path string, ids []uint64) {
+	q.spoolLock.Lock()
+	defer q.spoolLock.Unlock()
+	if q.spoolWritten {
+		return
+	}
+	if err := writeSpool(path, q.pending.Snapshot(ids...)); err != nil {
+		q.current().logger.Error("Error updating spool file, replayed events may be repeated", "spool_file", path, "error", err)
+	}
+}
+
+// replaySpool processes and forwards events spooled by a previous shutdown. The spool file is updated as each
+// event is evaluated and forwarded, so if the server stops again, only what is left is replayed next time.
+func (q *WebhookQueryHandler) replaySpool(ctx context.Context, path string) {
+	events, err := readSpool(path)
+	if err != nil {
+		q.current().logger.Error("Error reading spool file, moving it aside", "spool_file", path, "error", err)
+		// Keep it out of the way of the next shutdown's spool, without losing what it holds.
+		if err := os.Rename(path, path+".bad"); err != nil {
+			q.current().logger.Error("Error moving spool file aside", "spool_file", path, "error", err)
+		}
+		return
+	}
+	if len(events) == 0 {
+		return
+	}
+	q.current().logger.Info("Replaying spooled events", "count", len(events), "spool_file", path)
+
+	ids := make([]uint64, len(events))
+	for i, event := range events {
+		ids[i] = q.pending.add(event)
+	}
+	ctx = q.withOutbound(ctx)
+	release := destination.Hold(ctx)
+	go func() {
+		defer release()
+		for i := range events {
+			processAndForward(ctx, &events[i].ProcessingEvent, q.webhookState, q.pending, ids[i], func() { q.updateSpool(path, ids) })
+			q.pending.Done(ids[i])
+			q.updateSpool(path, ids)
+		}
+	}()
+}
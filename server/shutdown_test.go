@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+)
+
+func TestDrainSpoolsPendingEventsAfterTimeout(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.ndjson")
+	handler := WebhookQueryHandler{
+		webhookState: webhook_tracker.NewLocalWebhookState(),
+		pending:      newPendingEvents(),
+	}
+
+	finished := handler.pending.Add(go_system_api.ProcessingEvent{Commands: go_system_api.CommandList{QueryId: "finished"}})
+	handler.pending.Add(go_system_api.ProcessingEvent{Commands: go_system_api.CommandList{QueryId: "stuck"}})
+	evaluated := handler.pending.Add(go_system_api.ProcessingEvent{Commands: go_system_api.CommandList{QueryId: "evaluated"}})
+	handler.pending.Done(finished)
+	handler.pending.Processed(evaluated)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := handler.drain(ctx, ShutdownConfig{SpoolFile: spool}); err == nil {
+		t.Fatal("expected drain to report the spooled event")
+	}
+
+	events, err := readSpool(spool)
+	if err != nil {
+		t.Fatalf("reading spool: %v", err)
+	}
+	progress := map[string]bool{}
+	for _, event := range events {
+		progress[event.Commands.QueryId] = event.Processed
+	}
+	if len(events) != 2 || progress["stuck"] || !progress["evaluated"] {
+		t.Fatalf("expected the stuck and evaluated events to be spooled with their progress, got %+v", events)
+	}
+}
+
+func TestDrainReturnsOnceEventsAreDone(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.ndjson")
+	handler := WebhookQueryHandler{
+		webhookState: webhook_tracker.NewLocalWebhookState(),
+		pending:      newPendingEvents(),
+	}
+	id := handler.pending.Add(go_system_api.ProcessingEvent{Commands: go_system_api.CommandList{QueryId: "slow"}})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		handler.pending.Done(id)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := handler.drain(ctx, ShutdownConfig{SpoolFile: spool}); err != nil {
+		t.Fatalf("expected drain to finish, got %v", err)
+	}
+
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be spooled, got %v", err)
+	}
+}
+
+func TestReplaySpoolResumesWhereItStopped(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "spool.ndjson")
+	var webhooks atomic.Int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { webhooks.Add(1) }))
+	defer target.Close()
+	forwarding, resume := make(chan string, 2), make(chan struct{})
+	next := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event go_system_api.ProcessingEvent
+		_ = json.NewDecoder(r.Body).Decode(&event)
+		forwarding <- event.Commands.QueryId
+		if event.Commands.QueryId == "pending" {
+			<-resume
+		}
+	}))
+	defer next.Close()
+
+	event := func(queryID string) go_system_api.ProcessingEvent {
+		return go_system_api.ProcessingEvent{
+			Commands: go_system_api.CommandList{QueryId: queryID, Commands: []go_system_api.CommandStep{
+				{CommandName: "webhook", Args: "fieldname>=1 " + target.URL},
+				{CommandName: "next", Url: next.URL},
+			}},
+			Event: go_system_api.EventData{Derived: map[string]interface{}{"fieldname": 5}},
+		}
+	}
+	// The first event had its webhook called before it was spooled, so only forwarding is left.
+	err := writeSpool(spool, []spooledEvent{{ProcessingEvent: event("evaluated"), Processed: true}, {ProcessingEvent: event("pending")}})
+	if err != nil {
+		t.Fatalf("writing spool: %s", err)
+	}
+
+	handler := WebhookQueryHandler{
+		webhookState: webhook_tracker.NewLocalWebhookState(),
+		pending:      newPendingEvents(),
+	}
+	handler.replaySpool(allowLoopback(context.Background()), spool)
+
+	for _, expected := range []string{"evaluated", "pending"} {
+		select {
+		case queryID := <-forwarding:
+			if queryID != expected {
+				t.Fatalf("expected %s to be forwarded, got %s", expected, queryID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s to be forwarded", expected)
+		}
+	}
+	// The second event is being forwarded: the spool has only it left, with its webhook done.
+	events, err := readSpool(spool)
+	if err != nil || len(events) != 1 || events[0].Commands.QueryId != "pending" || !events[0].Processed {
+		t.Fatalf("expected the spool to hold the event being forwarded, got %+v, %v", events, err)
+	}
+	close(resume)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if !handler.pending.Wait(ctx) {
+		t.Fatal("timed out waiting for the replay")
+	}
+	if count := webhooks.Load(); count != 1 {
+		t.Errorf("expected only the webhook that wasn't called before to be called, got %d calls", count)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Errorf("expected the spool file to be removed once replayed, got %v", err)
+	}
+}
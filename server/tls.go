@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// tlsReloadDelay lets a rotation that writes the certificate and key separately finish before reloading.
+const tlsReloadDelay = 100 * time.Millisecond
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion turns a version like "1.2" into its crypto/tls constant. Empty means TLS 1.2.
+func ParseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return tls.VersionTLS12, nil
+	}
+	if parsed, ok := tlsVersions[version]; ok {
+		return parsed, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected one of 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// TLSFiles serves HTTPS from files on disk, which are reloaded when they change.
+type TLSFiles struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies the certificates clients present against these CAs (mTLS). Clients without one can
+	// still connect, for health checks and metrics, so use the ClientCertificates authenticator to require them.
+	ClientCAFile string
+	// MinVersion defaults to TLS 1.2.
+	MinVersion uint16
+}
+
+// CertificateReloader keeps a TLS config built from TLSFiles up to date as the files are rotated.
+// A rotation that can't be loaded is logged, and the previous certificate is kept.
+type CertificateReloader struct {
+	files   TLSFiles
+	current atomic.Pointer[tls.Config]
+}
+
+// NewCertificateReloader loads the files, failing if they can't be used.
+func NewCertificateReloader(files TLSFiles) (*CertificateReloader, error) {
+	r := &CertificateReloader{files: files}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a config that picks up the latest certificate and client CAs on every handshake.
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: r.minVersion(),
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+func (r *CertificateReloader) minVersion() uint16 {
+	if r.files.MinVersion == 0 {
+		return tls.VersionTLS12
+	}
+	return r.files.MinVersion
+}
+
+// Reload reads the files again. On error the previous config stays in use.
+func (r *CertificateReloader) Reload() error {
+	certificate, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   r.minVersion(),
+	}
+	if r.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("loading client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("loading client CAs: no certificates found in %s", r.files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	if previous := r.current.Swap(config); previous != nil && !bytes.Equal(previous.Certificates[0].Certificate[0], certificate.Certificate[0]) {
+		slog.Info("Reloaded TLS certificate", "cert_file", r.files.CertFile)
+	}
+	return nil
+}
+
+// Watch reloads the files whenever they change, until ctx is cancelled. The directories are watched rather than
+// the files, so certificates replaced by a rename or a symlink swap, as Kubernetes does with secrets, are picked up.
+func (r *CertificateReloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watching TLS files: %w", err)
+	}
+	dirs := map[string]bool{}
+	for _, file := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile} {
+		if file == "" || dirs[filepath.Dir(file)] {
+			continue
+		}
+		dirs[filepath.Dir(file)] = true
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("watching TLS files: %w", err)
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		reload := time.NewTimer(tlsReloadDelay)
+		reload.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				reload.Stop()
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				reload.Reset(tlsReloadDelay)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Warn("Error watching TLS files", "error", err)
+			case <-reload.C:
+				if err := r.Reload(); err != nil {
+					slog.Error("Could not reload TLS files, keeping the previous certificate", "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	certificate, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	if err != nil {
+		t.Fatalf("building key pair: %s", err)
+	}
+	return certificate
+}
+
+// newTestCert issues a certificate for name, self-signed when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshalling key: %s", err)
+	}
+	return testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	// Write then rename, the way certificates are usually rotated, so the server never sees half a file.
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		t.Fatalf("writing %s: %s", path, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		t.Fatalf("renaming %s: %s", path, err)
+	}
+}
+
+func startTLSServer(t *testing.T, files TLSFiles, opts ...Option) *Server {
+	t.Helper()
+	srv := New(append([]Option{WithAddr("127.0.0.1:0"), WithTLSFiles(files)}, opts...)...)
+	if err := srv.Start(context.Background()); err != nil {
+		t.Fatalf("starting server: %s", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv
+}
+
+func tlsClient(roots *x509.CertPool, certificates ...tls.Certificate) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: certificates},
+		DisableKeepAlives: true,
+	}}
+}
+
+// servedCert returns the certificate the server presents.
+func servedCert(t *testing.T, srv *Server, roots *x509.CertPool) *x509.Certificate {
+	t.Helper()
+	conn, err := tls.Dial("tcp", srv.Addr(), &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("connecting: %s", err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSReloadsRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	first, second := newTestCert(t, "first", &ca), newTestCert(t, "second", &ca)
+	files := TLSFiles{CertFile: filepath.Join(dir, "tls.crt"), KeyFile: filepath.Join(dir, "tls.key")}
+	writeFile(t, files.CertFile, first.certPEM)
+	writeFile(t, files.KeyFile, first.keyPEM)
+
+	srv := startTLSServer(t, files)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if name := servedCert(t, srv, roots).Subject.CommonName; name != "first" {
+		t.Fatalf("expected the first certificate to be served, got %s", name)
+	}
+
+	// A key that doesn't match the certificate is rejected, and the previous pair kept.
+	writeFile(t, files.CertFile, second.certPEM)
+	time.Sleep(3 * tlsReloadDelay)
+	if name := servedCert(t, srv, roots).Subject.CommonName; name != "first" {
+		t.Fatalf("expected a mismatched rotation to keep the first certificate, got %s", name)
+	}
+
+	writeFile(t, files.KeyFile, second.keyPEM)
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCert(t, srv, roots).Subject.CommonName != "second" {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the rotated certificate to be served")
+		}
+		time.Sleep(tlsReloadDelay)
+	}
+}
+
+func TestTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca, clientCA := newTestCert(t, "ca", nil), newTestCert(t, "client-ca", nil)
+	serverCert := newTestCert(t, "server", &ca)
+	client, stranger := newTestCert(t, "upstream", &clientCA), newTestCert(t, "stranger", &ca)
+	files := TLSFiles{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "client-ca.crt"),
+		MinVersion:   tls.VersionTLS13,
+	}
+	writeFile(t, files.CertFile, serverCert.certPEM)
+	writeFile(t, files.KeyFile, serverCert.keyPEM)
+	writeFile(t, files.ClientCAFile, clientCA.certPEM)
+
+	srv := startTLSServer(t, files, WithAuthenticators(ClientCertificates()))
+	base := "https://" + srv.Addr()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	status := func(client *http.Client, method string, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, base+path, strings.NewReader(authBody))
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	// Probes and scrapers don't have certificates, /query is where they are required.
+	if code := status(tlsClient(roots), http.MethodGet, "/livez"); code != http.StatusOK {
+		t.Errorf("expected /livez to be open to clients without a certificate, got %d", code)
+	}
+	if code := status(tlsClient(roots), http.MethodPost, "/query"); code != http.StatusUnauthorized {
+		t.Errorf("expected /query to refuse a client without a certificate, got %d", code)
+	}
+	// The client doesn't offer a certificate the server's CAs didn't sign, so it is treated as having none.
+	if code := status(tlsClient(roots, stranger.tlsCertificate(t)), http.MethodPost, "/query"); code != http.StatusUnauthorized {
+		t.Errorf("expected /query to refuse a client certificate from another CA, got %d", code)
+	}
+	if code := status(tlsClient(roots, client.tlsCertificate(t)), http.MethodPost, "/query"); code != accepted {
+		t.Errorf("expected a client certificate from the client CA to be accepted on /query, got %d", code)
+	}
+
+	old := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tlsCertificate(t)}, MaxVersion: tls.VersionTLS12}
+	if conn, err := tls.Dial("tcp", srv.Addr(), old); err == nil {
+		_ = conn.Close()
+		t.Error("expected TLS 1.2 to be refused with a minimum version of 1.3")
+	}
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"time"
+
+	webhook_tracker "github.com/DeltaScratchpad/webhook-interface/webhook-tracker"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracedState starts a span around every call to the wrapped backend.
+type tracedState struct {
+	state webhook_tracker.WebhookState
+}
+
+func InstrumentState(state webhook_tracker.WebhookState) webhook_tracker.WebhookState {
+	return &tracedState{state: state}
+}
+
+func startStateSpan(ctx context.Context, operation string, webhook string, queryID string) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "WebhookState."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("webhook.url", URL(webhook)),
+			attribute.String("query.id", queryID),
+		))
+}
+
+func (t *tracedState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
+	ctx, span := startStateSpan(ctx, "IncrementCallCount", webhook, queryID)
+	defer span.End()
+	count := t.state.IncrementCallCount(ctx, webhook, queryID)
+	span.SetAttributes(attribute.Int64("webhook.call_count", count))
+	return count
+}
+
+func (t *tracedState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
+	ctx, span := startStateSpan(ctx, "HasBeenCalled", webhook, queryID)
+	defer span.End()
+	called := t.state.HasBeenCalled(ctx, webhook, queryID)
+	span.SetAttributes(attribute.Bool("webhook.called", called))
+	return called
+}
+
+func (t *tracedState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	ctx, span := Tracer().Start(ctx, "WebhookState.PurgeExpired", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	purged, err := t.state.PurgeExpired(ctx, ttl)
+	span.SetAttributes(attribute.Int64("webhook.purged", purged))
+	RecordError(span, err)
+	return purged, err
+}
+
+func (t *tracedState) Ping(ctx context.Context) error {
+	ctx, span := Tracer().Start(ctx, "WebhookState.Ping", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	err := t.state.Ping(ctx)
+	RecordError(span, err)
+	return err
+}
@@ -0,0 +1,138 @@
+package webhook_tracker
+
+import (
+	"context"
+	"encoding/binary"
+	"log/slog"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("webhook_stats")
+
+// BoltState stores call counts in an embedded bbolt file, so they survive restarts
+// without needing an external database.
+type BoltState struct {
+	db *bolt.DB
+}
+
+func NewBoltState(path string) (*BoltState, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	slog.Info("Opened state file", "path", path)
+
+	return &BoltState{
+		db: db,
+	}, nil
+}
+
+func boltKey(webhook string, queryID string) []byte {
+	// The NUL separator keeps ("ab", "c") and ("a", "bc") from sharing a key.
+	return []byte(webhook + "\x00" + queryID)
+}
+
+// Values are the call count followed by the last update time in Unix nanoseconds, both big-endian.
+func encodeBoltValue(count int64, updated time.Time) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], uint64(count))
+	binary.BigEndian.PutUint64(buf[8:], uint64(updated.UnixNano()))
+	return buf
+}
+
+func decodeBoltValue(value []byte) (count int64, updated int64) {
+	if len(value) >= 8 {
+		count = int64(binary.BigEndian.Uint64(value[:8]))
+	}
+	if len(value) >= 16 {
+		updated = int64(binary.BigEndian.Uint64(value[8:16]))
+	}
+	return
+}
+
+func (b *BoltState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
+	var value int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		key := boltKey(webhook, queryID)
+		value, _ = decodeBoltValue(bucket.Get(key))
+		value++
+		return bucket.Put(key, encodeBoltValue(value, time.Now()))
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error updating state file", "error", err)
+		return 0
+	}
+	return value
+}
+
+func (b *BoltState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
+	var called bool
+	err := b.db.View(func(tx *bolt.Tx) error {
+		called = tx.Bucket(boltBucket).Get(boltKey(webhook, queryID)) != nil
+		return nil
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error reading state file", "error", err)
+		return false
+	}
+	return called
+}
+
+func (b *BoltState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-ttl).UnixNano()
+	var purged int64
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		// Collect first, as deleting while iterating a cursor skips entries.
+		var expired [][]byte
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			if _, updated := decodeBoltValue(value); updated < cutoff {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		purged = int64(len(expired))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
+
+func (b *BoltState) Ping(ctx context.Context) error {
+	// A read transaction fails once the file has been closed.
+	return b.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(boltBucket) == nil {
+			return bolt.ErrBucketNotFound
+		}
+		return nil
+	})
+}
+
+// Close releases the lock on the state file.
+func (b *BoltState) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,44 @@
+package webhook_tracker
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltStateSurvivesReopen(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	state, err := NewBoltState(path)
+	if err != nil {
+		t.Fatalf("opening state: %s", err)
+	}
+	if state.HasBeenCalled(ctx, "http://example.com/hook", "query-1") {
+		t.Fatal("fresh state reported webhook as called")
+	}
+	if count := state.IncrementCallCount(ctx, "http://example.com/hook", "query-1"); count != 1 {
+		t.Fatalf("expected count 1, got %d", count)
+	}
+	if count := state.IncrementCallCount(ctx, "http://example.com/hook", "query-1"); count != 2 {
+		t.Fatalf("expected count 2, got %d", count)
+	}
+	if err := state.Close(); err != nil {
+		t.Fatalf("closing state: %s", err)
+	}
+
+	reopened, err := NewBoltState(path)
+	if err != nil {
+		t.Fatalf("reopening state: %s", err)
+	}
+	defer reopened.Close()
+	if !reopened.HasBeenCalled(ctx, "http://example.com/hook", "query-1") {
+		t.Fatal("call count was lost after reopening the state file")
+	}
+	if reopened.HasBeenCalled(ctx, "http://example.com/hook", "query-2") {
+		t.Fatal("unrelated query reported as called")
+	}
+	if count := reopened.IncrementCallCount(ctx, "http://example.com/hook", "query-1"); count != 3 {
+		t.Fatalf("expected count 3 after reopen, got %d", count)
+	}
+}
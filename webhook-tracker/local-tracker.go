@@ -1,50 +1,79 @@
 package webhook_tracker
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+type localEntry struct {
+	count       atomic.Int64
+	lastUpdated atomic.Int64 // Unix nanoseconds
+}
+
 type LocalWebhookState struct {
-	callCounts map[string]*atomic.Int64
+	callCounts map[string]*localEntry
 	callLock   *sync.RWMutex
 }
 
 func NewLocalWebhookState() *LocalWebhookState {
 	return &LocalWebhookState{
-		callCounts: make(map[string]*atomic.Int64),
+		callCounts: make(map[string]*localEntry),
 		callLock:   new(sync.RWMutex),
 	}
 }
 
-func (l *LocalWebhookState) IncrementCallCount(webhook string, queryID string) int64 {
+func (l *LocalWebhookState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
 
 	// First optimistically just try to use a read lock
 	l.callLock.RLock()
 	val, ok := l.callCounts[webhook+queryID]
 	if ok {
 		l.callLock.RUnlock()
-		return val.Add(1)
+		val.lastUpdated.Store(time.Now().UnixNano())
+		return val.count.Add(1)
 	} else {
 		l.callLock.RUnlock()
 		l.callLock.Lock()
 		val, ok = l.callCounts[webhook+queryID]
 		if ok {
 			l.callLock.Unlock()
-			return val.Add(1)
+			val.lastUpdated.Store(time.Now().UnixNano())
+			return val.count.Add(1)
 		} else {
-			var counter atomic.Int64
-			counter.Store(1)
-			l.callCounts[webhook+queryID] = &counter
+			var entry localEntry
+			entry.count.Store(1)
+			entry.lastUpdated.Store(time.Now().UnixNano())
+			l.callCounts[webhook+queryID] = &entry
 			l.callLock.Unlock()
 			return 1
 		}
 	}
 }
 
-func (l *LocalWebhookState) HasBeenCalled(webhook string, queryID string) bool {
+func (l *LocalWebhookState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
 	l.callLock.RLock()
 	defer l.callLock.RUnlock()
 	_, ok := l.callCounts[webhook+queryID]
 	return ok
 }
+
+func (l *LocalWebhookState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	cutoff := time.Now().Add(-ttl).UnixNano()
+	var purged int64
+
+	l.callLock.Lock()
+	defer l.callLock.Unlock()
+	for key, entry := range l.callCounts {
+		if entry.lastUpdated.Load() < cutoff {
+			delete(l.callCounts, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (l *LocalWebhookState) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+package webhook_tracker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLocalPurgeExpired(t *testing.T) {
+	ctx := context.Background()
+	state := NewLocalWebhookState()
+	state.IncrementCallCount(ctx, "http://example.com/old", "query-1")
+	time.Sleep(20 * time.Millisecond)
+	state.IncrementCallCount(ctx, "http://example.com/new", "query-1")
+
+	purged, err := state.PurgeExpired(ctx, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("purging: %s", err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 entry purged, got %d", purged)
+	}
+	if state.HasBeenCalled(ctx, "http://example.com/old", "query-1") {
+		t.Fatal("expired entry was not purged")
+	}
+	if !state.HasBeenCalled(ctx, "http://example.com/new", "query-1") {
+		t.Fatal("recent entry was purged")
+	}
+}
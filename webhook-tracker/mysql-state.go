@@ -1,9 +1,11 @@
 package webhook_tracker
 
 import (
+	"context"
 	"database/sql"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
 	_ "github.com/go-sql-driver/mysql"
-	"log"
+	"log/slog"
 	"time"
 )
 
@@ -11,68 +13,86 @@ type MySqlState struct {
 	dbConn *sql.DB
 }
 
-func NewMySqlState(db_url string) *MySqlState {
+func NewMySqlState(db_url string) (*MySqlState, error) {
 	db, err := sql.Open("mysql", db_url)
 
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	db.SetConnMaxLifetime(time.Minute * 3)
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
 
-	log.Println("Connected to MySQL")
+	slog.Info("Connected to MySQL")
 
 	return &MySqlState{
 		dbConn: db,
-	}
+	}, nil
+}
+
+func (m *MySqlState) Close() error {
+	return m.dbConn.Close()
 }
 
-func (m *MySqlState) IncrementCallCount(webhook string, queryID string) int64 {
+func (m *MySqlState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
+	logger := logging.FromContext(ctx)
 	// Use a mysql upsert to set the counter to 1 if it doesn't exist, otherwise increment it
 	// This should be done in a transaction
-	tx, err := m.dbConn.Begin()
+	tx, err := m.dbConn.BeginTx(ctx, nil)
 	if err != nil {
-		log.Printf("Error starting transaction: %s", err)
+		logger.Error("Error starting transaction", "error", err)
 		return 0
 	}
 	defer func(tx *sql.Tx) {
 		_ = tx.Commit()
 	}(tx)
 	// First try to update the counter
-	stmt, err := tx.Prepare("INSERT INTO `webhook_stats` (`webhook`, `query_id`, `invoke_count`) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE `invoke_count` = `invoke_count` + 1")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO `webhook_stats` (`webhook`, `query_id`, `invoke_count`) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE `invoke_count` = `invoke_count` + 1, `updated_at` = CURRENT_TIMESTAMP")
 	if err != nil {
-		log.Printf("Error preparing statement: %s", err)
+		logger.Error("Error preparing statement", "error", err)
 		return 0
 	}
 	defer func(stmt *sql.Stmt) {
 		_ = stmt.Close()
 	}(stmt)
-	_, err = stmt.Exec(webhook, queryID)
+	_, err = stmt.ExecContext(ctx, webhook, queryID)
 
 	if err != nil {
-		log.Printf("Error executing statement: %s", err)
+		logger.Error("Error executing statement", "error", err)
 		return 0
 	}
 
 	// Now get the value
 	var value int64
-	err = tx.QueryRow("SELECT `invoke_count` FROM `webhook_stats` WHERE `webhook` = ? AND `query_id` = ?", webhook, queryID).Scan(&value)
+	err = tx.QueryRowContext(ctx, "SELECT `invoke_count` FROM `webhook_stats` WHERE `webhook` = ? AND `query_id` = ?", webhook, queryID).Scan(&value)
 	if err != nil {
-		log.Printf("Error getting value: %s", err)
+		logger.Error("Error getting value", "error", err)
 		return 0
 	}
 	return value
 }
 
-func (m *MySqlState) HasBeenCalled(webhook string, queryID string) bool {
+func (m *MySqlState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
 	// If the invoke count is greater than 0, return true, otherwise false
 	var value int64
-	err := m.dbConn.QueryRow("SELECT `invoke_count` FROM `webhook_stats` WHERE `webhook` = ? AND `query_id` = ?", webhook, queryID).Scan(&value)
+	err := m.dbConn.QueryRowContext(ctx, "SELECT `invoke_count` FROM `webhook_stats` WHERE `webhook` = ? AND `query_id` = ?", webhook, queryID).Scan(&value)
 	if err != nil {
-		log.Printf("Error getting value: %s", err)
+		logging.FromContext(ctx).Error("Error getting value", "error", err)
 		return false
 	}
 	return value > 0
 
 }
+
+func (m *MySqlState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	// Compare against the database clock so the result doesn't depend on timezone settings
+	result, err := m.dbConn.ExecContext(ctx, "DELETE FROM `webhook_stats` WHERE `updated_at` < NOW() - INTERVAL ? SECOND", int64(ttl.Seconds()))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (m *MySqlState) Ping(ctx context.Context) error {
+	return m.dbConn.PingContext(ctx)
+}
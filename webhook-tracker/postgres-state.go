@@ -0,0 +1,72 @@
+package webhook_tracker
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+	_ "github.com/lib/pq"
+	"log/slog"
+	"time"
+)
+
+type PostgresState struct {
+	dbConn *sql.DB
+}
+
+func NewPostgresState(db_url string) (*PostgresState, error) {
+	db, err := sql.Open("postgres", db_url)
+
+	if err != nil {
+		return nil, err
+	}
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+
+	slog.Info("Connected to PostgreSQL")
+
+	return &PostgresState{
+		dbConn: db,
+	}, nil
+}
+
+func (p *PostgresState) Close() error {
+	return p.dbConn.Close()
+}
+
+func (p *PostgresState) IncrementCallCount(ctx context.Context, webhook string, queryID string) int64 {
+	// Postgres can upsert and return the new value in a single statement, so no transaction is needed.
+	var value int64
+	err := p.dbConn.QueryRowContext(ctx, "INSERT INTO webhook_stats (webhook, query_id, invoke_count) VALUES ($1, $2, 1) ON CONFLICT (webhook, query_id) DO UPDATE SET invoke_count = webhook_stats.invoke_count + 1, updated_at = NOW() RETURNING invoke_count", webhook, queryID).Scan(&value)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error executing statement", "error", err)
+		return 0
+	}
+	return value
+}
+
+func (p *PostgresState) HasBeenCalled(ctx context.Context, webhook string, queryID string) bool {
+	// If the invoke count is greater than 0, return true, otherwise false
+	var value int64
+	err := p.dbConn.QueryRowContext(ctx, "SELECT invoke_count FROM webhook_stats WHERE webhook = $1 AND query_id = $2", webhook, queryID).Scan(&value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logging.FromContext(ctx).Error("Error getting value", "error", err)
+		}
+		return false
+	}
+	return value > 0
+}
+
+func (p *PostgresState) PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error) {
+	// Compare against the database clock so the result doesn't depend on timezone settings
+	result, err := p.dbConn.ExecContext(ctx, "DELETE FROM webhook_stats WHERE updated_at < NOW() - make_interval(secs => $1)", ttl.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (p *PostgresState) Ping(ctx context.Context) error {
+	return p.dbConn.PingContext(ctx)
+}
@@ -0,0 +1,150 @@
+package webhook_tracker
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/schema"
+)
+
+// sqlBackend is a SQL state backend tested against a scratch database named by an environment variable.
+// Its tables are dropped and migrated again.
+type sqlBackend struct {
+	dialect string
+	env     string
+	open    func(dsn string) (WebhookState, *sql.DB, error)
+	// age moves the updated_at of a query's entries an hour into the past.
+	age string
+}
+
+var sqlBackends = []sqlBackend{
+	{
+		dialect: schema.MySQL,
+		env:     "TEST_MYSQL_DSN",
+		open: func(dsn string) (WebhookState, *sql.DB, error) {
+			state, err := NewMySqlState(dsn)
+			if err != nil {
+				return nil, nil, err
+			}
+			return state, state.dbConn, nil
+		},
+		age: "UPDATE `webhook_stats` SET `updated_at` = NOW() - INTERVAL 1 HOUR WHERE `query_id` = ?",
+	},
+	{
+		dialect: schema.Postgres,
+		env:     "TEST_POSTGRES_URL",
+		open: func(dsn string) (WebhookState, *sql.DB, error) {
+			state, err := NewPostgresState(dsn)
+			if err != nil {
+				return nil, nil, err
+			}
+			return state, state.dbConn, nil
+		},
+		age: "UPDATE webhook_stats SET updated_at = NOW() - INTERVAL '1 hour' WHERE query_id = $1",
+	},
+}
+
+func openSQLState(t *testing.T, backend sqlBackend) (WebhookState, *sql.DB) {
+	t.Helper()
+	dsn := os.Getenv(backend.env)
+	if dsn == "" {
+		t.Skipf("%s is not set", backend.env)
+	}
+	state, db, err := backend.open(dsn)
+	if err != nil {
+		t.Fatalf("opening state: %s", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	for _, table := range []string{"webhook_stats", "schema_migrations"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table); err != nil {
+			t.Fatalf("dropping %s: %s", table, err)
+		}
+	}
+	migrator, err := schema.NewMigrator(db, backend.dialect)
+	if err != nil {
+		t.Fatalf("building migrator: %s", err)
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+	return state, db
+}
+
+func TestSQLStateCountsCalls(t *testing.T) {
+	for _, backend := range sqlBackends {
+		t.Run(backend.dialect, func(t *testing.T) {
+			ctx := context.Background()
+			state, _ := openSQLState(t, backend)
+
+			if err := state.Ping(ctx); err != nil {
+				t.Fatalf("expected the database to be reachable, got %s", err)
+			}
+			if state.HasBeenCalled(ctx, "http://example.com/hook", "query-1") {
+				t.Fatal("fresh state reported webhook as called")
+			}
+			for want := int64(1); want <= 3; want++ {
+				if count := state.IncrementCallCount(ctx, "http://example.com/hook", "query-1"); count != want {
+					t.Fatalf("expected count %d, got %d", want, count)
+				}
+			}
+			if !state.HasBeenCalled(ctx, "http://example.com/hook", "query-1") {
+				t.Fatal("webhook was not reported as called")
+			}
+			if state.HasBeenCalled(ctx, "http://example.com/hook", "query-2") || state.HasBeenCalled(ctx, "http://example.com/other", "query-1") {
+				t.Fatal("unrelated webhook or query reported as called")
+			}
+			if count := state.IncrementCallCount(ctx, "http://example.com/other", "query-1"); count != 1 {
+				t.Fatalf("expected another webhook to be counted separately, got %d", count)
+			}
+		})
+	}
+}
+
+func TestSQLStatePurgeExpired(t *testing.T) {
+	for _, backend := range sqlBackends {
+		t.Run(backend.dialect, func(t *testing.T) {
+			ctx := context.Background()
+			state, db := openSQLState(t, backend)
+			state.IncrementCallCount(ctx, "http://example.com/old", "query-1")
+			state.IncrementCallCount(ctx, "http://example.com/new", "query-2")
+			state.IncrementCallCount(ctx, "http://example.com/touched", "query-3")
+			if _, err := db.Exec(backend.age, "query-1"); err != nil {
+				t.Fatalf("ageing entries: %s", err)
+			}
+			if _, err := db.Exec(backend.age, "query-3"); err != nil {
+				t.Fatalf("ageing entries: %s", err)
+			}
+			// Calling a webhook again keeps its entry from expiring.
+			state.IncrementCallCount(ctx, "http://example.com/touched", "query-3")
+
+			purged, err := state.PurgeExpired(ctx, 10*time.Minute)
+			if err != nil {
+				t.Fatalf("purging: %s", err)
+			}
+			if purged != 1 {
+				t.Fatalf("expected 1 entry purged, got %d", purged)
+			}
+			if state.HasBeenCalled(ctx, "http://example.com/old", "query-1") {
+				t.Fatal("expired entry was not purged")
+			}
+			if !state.HasBeenCalled(ctx, "http://example.com/new", "query-2") || !state.HasBeenCalled(ctx, "http://example.com/touched", "query-3") {
+				t.Fatal("recent entry was purged")
+			}
+		})
+	}
+}
+
+func TestSQLStatePingFailsWhenClosed(t *testing.T) {
+	for _, backend := range sqlBackends {
+		t.Run(backend.dialect, func(t *testing.T) {
+			state, db := openSQLState(t, backend)
+			_ = db.Close()
+			if err := state.Ping(context.Background()); err == nil {
+				t.Fatal("expected ping to fail once the database is closed")
+			}
+		})
+	}
+}
@@ -1,11 +1,48 @@
 package webhook_tracker
 
+import (
+	"context"
+	"time"
+
+	"github.com/DeltaScratchpad/webhook-interface/logging"
+)
+
 type WebhookState interface {
 
 	// IncrementCallCount Increment the call count for a given webhook and query ID.
 	// Returns the new call count
-	IncrementCallCount(webhook string, queryID string) int64
+	IncrementCallCount(ctx context.Context, webhook string, queryID string) int64
 
 	// HasBeenCalled Check if a webhook has been called for a given query ID
-	HasBeenCalled(webhook string, queryID string) bool
+	HasBeenCalled(ctx context.Context, webhook string, queryID string) bool
+
+	// PurgeExpired Remove entries that have not been updated within the ttl.
+	// Returns the number of entries removed
+	PurgeExpired(ctx context.Context, ttl time.Duration) (int64, error)
+
+	// Ping Check that the backend is reachable and able to serve requests
+	Ping(ctx context.Context) error
+}
+
+// RunJanitor purges entries older than ttl from the state every interval, until ctx is cancelled.
+// It blocks, so callers are expected to run it in its own goroutine.
+func RunJanitor(ctx context.Context, state WebhookState, ttl time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := state.PurgeExpired(ctx, ttl)
+			if err != nil {
+				logging.FromContext(ctx).Error("Error purging expired webhook state", "error", err)
+				continue
+			}
+			if purged > 0 {
+				logging.FromContext(ctx).Info("Purged expired webhook state entries", "purged", purged)
+			}
+		}
+	}
 }
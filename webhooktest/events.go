@@ -0,0 +1,72 @@
+package webhooktest
+
+import (
+	"time"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+)
+
+// EventBuilder builds ProcessingEvents for tests. The zero step is the current one.
+type EventBuilder struct {
+	event go_system_api.ProcessingEvent
+}
+
+// NewEvent starts an event for queryID, with the raw, time, type and category fields filled in.
+func NewEvent(queryID string) *EventBuilder {
+	raw := "Test"
+	now := time.Now()
+	return &EventBuilder{event: go_system_api.ProcessingEvent{
+		Commands: go_system_api.CommandList{QueryId: queryID},
+		Event: go_system_api.EventData{
+			Raw:       &raw,
+			IndexTime: &now,
+			TimeStamp: &now,
+			EventType: &raw,
+			Category:  &raw,
+			Derived:   make(map[string]interface{}),
+		},
+	}}
+}
+
+// Field sets a derived field on the event.
+func (b *EventBuilder) Field(name string, value interface{}) *EventBuilder {
+	b.event.Event.Derived[name] = value
+	return b
+}
+
+// Webhook appends a webhook step that calls webhookURL when condition matches, e.g. "fieldname>=30".
+func (b *EventBuilder) Webhook(condition string, webhookURL string) *EventBuilder {
+	return b.Command("webhook", condition+" "+webhookURL, "")
+}
+
+// Next appends a step handled by the service at url.
+func (b *EventBuilder) Next(url string) *EventBuilder {
+	return b.Command("next", "", url)
+}
+
+// Command appends an arbitrary step.
+func (b *EventBuilder) Command(name string, args string, url string) *EventBuilder {
+	b.event.Commands.Commands = append(b.event.Commands.Commands, go_system_api.CommandStep{
+		CommandName: name,
+		Args:        args,
+		Url:         url,
+	})
+	return b
+}
+
+// Step sets the index of the current step.
+func (b *EventBuilder) Step(step int) *EventBuilder {
+	b.event.Commands.Step = step
+	return b
+}
+
+// ErrorURL sets where errors for the event are reported.
+func (b *EventBuilder) ErrorURL(url string) *EventBuilder {
+	b.event.Commands.ErrorUrl = url
+	return b
+}
+
+// Build returns the event. The builder can keep being used, but shares the derived fields with the result.
+func (b *EventBuilder) Build() go_system_api.ProcessingEvent {
+	return b.event
+}
@@ -0,0 +1,129 @@
+// Package webhooktest provides in-process fakes for testing pipeline stages: a recording
+// webhook receiver, next-stage and error URL sinks, a server constructor, and event builders.
+package webhooktest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout is how long the Wait helpers block before failing the test.
+const DefaultTimeout = 5 * time.Second
+
+// Request is a copy of a request received by a Recorder.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// Recorder is an HTTP server that records every request it receives and answers with a fixed status.
+type Recorder struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:41234
+	URL string
+
+	server   *httptest.Server
+	lock     sync.Mutex
+	status   map[string]int
+	requests []Request
+	received chan struct{}
+}
+
+// NewRecorder starts a Recorder that answers 200 to everything. It is closed when the test finishes.
+func NewRecorder(t testing.TB) *Recorder {
+	t.Helper()
+	r := &Recorder{
+		status:   make(map[string]int),
+		received: make(chan struct{}, 1),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	r.URL = r.server.URL
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+func (r *Recorder) serve(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.lock.Lock()
+	r.requests = append(r.requests, Request{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Query:  req.URL.Query(),
+		Header: req.Header.Clone(),
+		Body:   body,
+	})
+	status, ok := r.status[req.URL.Path]
+	if !ok {
+		status, ok = r.status[""]
+	}
+	r.lock.Unlock()
+
+	// Wake up anyone waiting, without blocking if nobody is.
+	select {
+	case r.received <- struct{}{}:
+	default:
+	}
+
+	if !ok {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+}
+
+// Endpoint returns the URL of path on this server.
+func (r *Recorder) Endpoint(path string) string {
+	return r.URL + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Respond sets the status returned for path. An empty path sets the status for every path without its own.
+func (r *Recorder) Respond(path string, status int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.status[path] = status
+}
+
+// Requests returns a copy of the requests received so far, in order.
+func (r *Recorder) Requests() []Request {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]Request(nil), r.requests...)
+}
+
+// Count returns the number of requests received so far.
+func (r *Recorder) Count() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.requests)
+}
+
+// WaitFor blocks until at least n requests have been received, failing the test after DefaultTimeout.
+func (r *Recorder) WaitFor(t testing.TB, n int) []Request {
+	t.Helper()
+	deadline := time.NewTimer(DefaultTimeout)
+	defer deadline.Stop()
+	for {
+		if requests := r.Requests(); len(requests) >= n {
+			return requests
+		}
+		select {
+		case <-r.received:
+		case <-deadline.C:
+			t.Fatalf("webhooktest: expected %d requests to %s, got %d after %s", n, r.URL, r.Count(), DefaultTimeout)
+			return nil
+		}
+	}
+}
+
+// Wait blocks until a request has been received and returns the first one.
+func (r *Recorder) Wait(t testing.TB) Request {
+	t.Helper()
+	return r.WaitFor(t, 1)[0]
+}
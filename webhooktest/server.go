@@ -0,0 +1,96 @@
+package webhooktest
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	"github.com/DeltaScratchpad/webhook-interface/egress"
+	"github.com/DeltaScratchpad/webhook-interface/server"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// Server is the webhook interface served on a random local port.
+type Server struct {
+	// URL is the base URL of the server, e.g. http://127.0.0.1:41234
+	URL string
+	// Addr is the host and port the server is bound to.
+	Addr string
+
+	server *httptest.Server
+}
+
+// loopback is where test servers listen. The default egress policy blocks it, like any private address.
+var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// LoopbackClient returns a client that may call test servers on loopback addresses, and is otherwise limited
+// by the default egress policy.
+func LoopbackClient() *http.Client {
+	return (&egress.Policy{AllowCIDRs: loopback}).Client(DefaultTimeout)
+}
+
+// AllowLoopback lets the server call webhooks, forward events and report errors to test servers on loopback addresses.
+func AllowLoopback() server.Option {
+	client := LoopbackClient()
+	return func(s *server.Server) {
+		server.WithWebhookClient(client)(s)
+		server.WithForwardClient(client)(s)
+	}
+}
+
+// NewServer starts the webhook interface on a random local port, with in-memory state and sync
+// ingest unless opts say otherwise. When the test finishes it is closed and its pending events drained.
+func NewServer(t testing.TB, opts ...server.Option) *Server {
+	t.Helper()
+	handler := server.New(opts...)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(func() {
+		srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+		if err := handler.Shutdown(ctx); err != nil {
+			t.Errorf("webhooktest: server did not drain: %s", err)
+		}
+	})
+	return &Server{
+		URL:    srv.URL,
+		Addr:   srv.Listener.Addr().String(),
+		server: srv,
+	}
+}
+
+// QueryURL is the URL to send single events to.
+func (s *Server) QueryURL() string {
+	return s.URL + "/query"
+}
+
+// Send posts event to /query and returns the response status.
+func (s *Server) Send(t testing.TB, event go_system_api.ProcessingEvent) int {
+	t.Helper()
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	jsonData, err := json.Marshal(&event)
+	if err != nil {
+		t.Fatalf("webhooktest: error marshalling event: %s", err)
+	}
+	return s.Post(t, "/query", jsonData)
+}
+
+// Post posts a raw body to path and returns the response status.
+func (s *Server) Post(t testing.TB, path string, body []byte) int {
+	t.Helper()
+	r, err := s.server.Client().Post(s.URL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("webhooktest: error posting to %s: %s", path, err)
+	}
+	_ = r.Body.Close()
+	return r.StatusCode
+}
+
+// Client returns an HTTP client for the server.
+func (s *Server) Client() *http.Client {
+	return s.server.Client()
+}
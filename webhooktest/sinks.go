@@ -0,0 +1,104 @@
+package webhooktest
+
+import (
+	"strings"
+	"testing"
+
+	go_system_api "github.com/DeltaScratchpad/go-system-api"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// EventSink stands in for the next stage of a pipeline, decoding the events forwarded to it.
+// Batches sent to its /batch endpoint are flattened into the same list.
+type EventSink struct {
+	*Recorder
+}
+
+// NewEventSink starts an EventSink. It is closed when the test finishes.
+func NewEventSink(t testing.TB) *EventSink {
+	t.Helper()
+	return &EventSink{Recorder: NewRecorder(t)}
+}
+
+// Events decodes every event received so far, in order.
+func (s *EventSink) Events(t testing.TB) []go_system_api.ProcessingEvent {
+	t.Helper()
+	return decodeEvents(t, s.Requests())
+}
+
+// WaitEvents blocks until at least n events have been received, failing the test after DefaultTimeout.
+func (s *EventSink) WaitEvents(t testing.TB, n int) []go_system_api.ProcessingEvent {
+	t.Helper()
+	// Each request carries at least one event, so waiting for n requests may wait for more than needed.
+	for requests := 1; ; requests++ {
+		events := decodeEvents(t, s.WaitFor(t, requests))
+		if len(events) >= n {
+			return events
+		}
+	}
+}
+
+// WaitEvent blocks until an event has been received and returns the first one.
+func (s *EventSink) WaitEvent(t testing.TB) go_system_api.ProcessingEvent {
+	t.Helper()
+	return s.WaitEvents(t, 1)[0]
+}
+
+func decodeEvents(t testing.TB, requests []Request) []go_system_api.ProcessingEvent {
+	t.Helper()
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var events []go_system_api.ProcessingEvent
+	for _, request := range requests {
+		if strings.HasSuffix(request.Path, "/batch") {
+			var batch []go_system_api.ProcessingEvent
+			if err := json.Unmarshal(request.Body, &batch); err != nil {
+				t.Fatalf("webhooktest: invalid batch sent to %s: %s", request.Path, err)
+			}
+			events = append(events, batch...)
+			continue
+		}
+		var event go_system_api.ProcessingEvent
+		if err := json.Unmarshal(request.Body, &event); err != nil {
+			t.Fatalf("webhooktest: invalid event sent to %s: %s", request.Path, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// ErrorSink stands in for an error URL, decoding the error reports sent to it.
+type ErrorSink struct {
+	*Recorder
+}
+
+// NewErrorSink starts an ErrorSink. It is closed when the test finishes.
+func NewErrorSink(t testing.TB) *ErrorSink {
+	t.Helper()
+	return &ErrorSink{Recorder: NewRecorder(t)}
+}
+
+// Errors decodes every error report received so far, in order.
+func (s *ErrorSink) Errors(t testing.TB) []go_system_api.ErrorBody {
+	t.Helper()
+	return decodeErrors(t, s.Requests())
+}
+
+// WaitError blocks until an error report has been received and returns the first one.
+func (s *ErrorSink) WaitError(t testing.TB) go_system_api.ErrorBody {
+	t.Helper()
+	return decodeErrors(t, s.WaitFor(t, 1))[0]
+}
+
+func decodeErrors(t testing.TB, requests []Request) []go_system_api.ErrorBody {
+	t.Helper()
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	errors := make([]go_system_api.ErrorBody, 0, len(requests))
+	for _, request := range requests {
+		var body go_system_api.ErrorBody
+		if err := json.Unmarshal(request.Body, &body); err != nil {
+			t.Fatalf("webhooktest: invalid error report sent to %s: %s", request.Path, err)
+		}
+		errors = append(errors, body)
+	}
+	return errors
+}